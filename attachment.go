@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	MaxAttachmentsPerMessage = 10
+	MaxAttachmentNameLength  = 255 // bytes
+)
+
+var (
+	ErrAttachmentTooLarge = fiber.NewError(fiber.StatusRequestEntityTooLarge, "file is too large")
+	ErrQuotaExceeded      = fiber.NewError(fiber.StatusRequestEntityTooLarge, "upload quota exceeded")
+)
+
+// inlineTypes are served for the browser to show, anything else is
+// downloaded so an uploaded page can not run in the origin of the app.
+var inlineTypes = []string{"image/gif", "image/jpeg", "image/png", "image/webp"}
+
+// Attachment is a file uploaded to be sent with a message. Messages keep a
+// copy of it, the store keeps the file.
+type Attachment struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"` // uploader
+	// RoomID is where the attachment was sent, set once. Its members may
+	// download it, before that only the uploader may.
+	RoomID    string `json:"roomId,omitempty"`
+	Name      string `json:"name"`
+	MimeType  string `json:"mimeType"`        // sniffed from the content, not taken from the client
+	Size      int64  `json:"size"`            // in bytes
+	Width     int    `json:"width,omitempty"` // images only, in pixels
+	Height    int    `json:"height,omitempty"`
+	CreatedAt int64  `json:"createdAt"` // in ms
+	// Thumbnails and a BlurHash placeholder are made of images, largest
+	// first, none of sizes the image is not larger than
+	Thumbnails  []Thumbnail `json:"thumbnails,omitempty"`
+	Placeholder string      `json:"placeholder,omitempty"`
+}
+
+type AttachmentStore interface {
+	// Create stores the file of a new attachment read from r and the files
+	// of its thumbnails, in their order. It fails with ErrQuotaExceeded if
+	// the files of its uploader would take more than quota bytes.
+	Create(attachment Attachment, r io.Reader, thumbnails [][]byte, quota int64) error
+	Load(id string) (attachment Attachment, ok bool)
+	// Open returns the file of an attachment.
+	Open(attachment Attachment) (*os.File, error)
+	// OpenThumbnail returns the file of the thumbnail of an attachment made
+	// for size.
+	OpenThumbnail(attachment Attachment, size int) (*os.File, error)
+	// Attach records the room an attachment is sent to. It returns false if
+	// it was sent to another room already, so access can not be widened by
+	// sending it again.
+	Attach(id string, roomID string) (attachment Attachment, ok bool)
+	// Remove deletes an attachment and its files, so it can not be
+	// downloaded anymore and no longer counts against the quota.
+	Remove(attachment Attachment) error
+}
+
+// DiskAttachmentStore keeps the files of each user in a directory of their
+// own, so quotas are counted from the disk every prefork process shares. The
+// metadata of an attachment sits next to them as <id>.json.
+type DiskAttachmentStore struct {
+	sync.Mutex // serializes metadata updates, quota checks lock the user dir instead
+	dir        string
+}
+
+var _ AttachmentStore = (*DiskAttachmentStore)(nil)
+
+func NewDiskAttachmentStore(dir string) *DiskAttachmentStore {
+	return &DiskAttachmentStore{
+		dir: dir,
+	}
+}
+
+func (s *DiskAttachmentStore) Create(attachment Attachment, r io.Reader, thumbnails [][]byte, quota int64) error {
+	if !safeName(attachment.ID) || !safeName(attachment.UserID) {
+		return fiber.ErrBadRequest
+	}
+	userDir := filepath.Join(s.dir, attachment.UserID)
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		return err
+	}
+
+	// The lock holds across the prefork processes, which share the disk, so
+	// two uploads of a user can not both pass the quota check
+	unlock, err := lockDir(userDir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	used, err := dirSize(userDir)
+	if err != nil {
+		return err
+	}
+	size := attachment.Size
+	for _, thumbnail := range thumbnails {
+		size += int64(len(thumbnail))
+	}
+	if used+size > quota {
+		return ErrQuotaExceeded
+	}
+
+	// Written aside first so a failed upload leaves no attachment behind
+	tmp, err := ioutil.TempFile(userDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(r, attachment.Size+1))
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	if n != attachment.Size {
+		return fiber.ErrBadRequest
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(userDir, attachment.ID)); err != nil {
+		return err
+	}
+	for i, thumbnail := range thumbnails {
+		name := fmt.Sprintf("%s-%d", attachment.ID, attachment.Thumbnails[i].Size)
+		if err := ioutil.WriteFile(filepath.Join(userDir, name), thumbnail, 0644); err != nil {
+			return err
+		}
+	}
+
+	// Written last, an attachment is only found once its files are complete
+	return s.write(attachment)
+}
+
+func (s *DiskAttachmentStore) Load(id string) (attachment Attachment, ok bool) {
+	if !safeName(id) {
+		return attachment, false
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id+".json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("%#v\n", err)
+		}
+		return attachment, false
+	}
+	if err := json.Unmarshal(b, &attachment); err != nil {
+		log.Printf("%#v\n", err)
+		return Attachment{}, false
+	}
+	return attachment, true
+}
+
+func (s *DiskAttachmentStore) Open(attachment Attachment) (*os.File, error) {
+	if !safeName(attachment.ID) || !safeName(attachment.UserID) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(filepath.Join(s.dir, attachment.UserID, attachment.ID))
+}
+
+func (s *DiskAttachmentStore) OpenThumbnail(attachment Attachment, size int) (*os.File, error) {
+	if !safeName(attachment.ID) || !safeName(attachment.UserID) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(filepath.Join(s.dir, attachment.UserID, fmt.Sprintf("%s-%d", attachment.ID, size)))
+}
+
+func (s *DiskAttachmentStore) Attach(id string, roomID string) (attachment Attachment, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	attachment, ok = s.Load(id)
+	if !ok {
+		return attachment, false
+	}
+	if attachment.RoomID == roomID {
+		return attachment, true
+	}
+	if attachment.RoomID != "" {
+		return attachment, false
+	}
+
+	attachment.RoomID = roomID
+	if err := s.write(attachment); err != nil {
+		log.Printf("%#v\n", err)
+		return attachment, false
+	}
+	return attachment, true
+}
+
+func (s *DiskAttachmentStore) Remove(attachment Attachment) error {
+	if !safeName(attachment.ID) || !safeName(attachment.UserID) {
+		return os.ErrNotExist
+	}
+	userDir := filepath.Join(s.dir, attachment.UserID)
+
+	s.Lock()
+	defer s.Unlock()
+
+	// The metadata goes first, the attachment is not found from then on even
+	// if removing its files fails
+	names := []string{filepath.Join(s.dir, attachment.ID+".json"), filepath.Join(userDir, attachment.ID)}
+	for _, thumbnail := range attachment.Thumbnails {
+		names = append(names, filepath.Join(userDir, fmt.Sprintf("%s-%d", attachment.ID, thumbnail.Size)))
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// write replaces the metadata of an attachment at once, so readers never see
+// half of it.
+func (s *DiskAttachmentStore) write(attachment Attachment) error {
+	b, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.dir, ".meta-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, attachment.ID+".json"))
+}
+
+// safeName reports whether s can be used as a single path element.
+func safeName(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`) && !strings.HasPrefix(s, ".")
+}
+
+// dirSize adds up the sizes of the files in dir.
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue // removed meanwhile
+			}
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// attachmentName cleans up the name a client gave a file.
+func attachmentName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, `\`, "/")))
+	for len(name) > MaxAttachmentNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// UploadAttachment stores a file to be sent with a message and returns it,
+// its id to put in the attachments of SEND_MESSAGE.
+//
+//	POST /api/attachments multipart/form-data with the file in "file"
+func (h *Hub) UploadAttachment(c *fiber.Ctx) error {
+	userID, err := h.bearer(c)
+	if err != nil {
+		return err
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		return fiber.ErrBadRequest
+	}
+	if header.Size > h.Options.MaxAttachmentSize {
+		return ErrAttachmentTooLarge
+	}
+	file, err := header.Open()
+	if err != nil {
+		return fiber.ErrBadRequest
+	}
+	defer file.Close()
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fiber.ErrInternalServerError
+	}
+	attachment := Attachment{
+		ID:        id.String(),
+		UserID:    userID,
+		Name:      attachmentName(header.Filename),
+		Size:      header.Size,
+		CreatedAt: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+
+	// The type the client claims is not trusted, the content tells
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fiber.ErrBadRequest
+	}
+	attachment.MimeType = http.DetectContentType(head[:n])
+	if strings.HasPrefix(attachment.MimeType, "image/") {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fiber.ErrInternalServerError
+		}
+		if config, _, err := image.DecodeConfig(file); err == nil {
+			attachment.Width, attachment.Height = config.Width, config.Height
+		}
+	}
+
+	// Images are sent with smaller copies for slow clients, an image that
+	// does not decode is still sent as it is
+	var files [][]byte
+	if attachment.Width > 0 && attachment.Width*attachment.Height <= MaxThumbnailPixels {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return fiber.ErrInternalServerError
+		}
+		if files, err = h.thumbnails(&attachment, file); err == fiber.ErrServiceUnavailable {
+			return err
+		} else if err != nil {
+			log.Printf("%#v\n", err)
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fiber.ErrInternalServerError
+	}
+
+	if err := h.attachment.Create(attachment, file, files, h.Options.AttachmentQuota); err != nil {
+		var e *fiber.Error
+		if errors.As(err, &e) {
+			return e
+		}
+		log.Printf("%#v\n", err)
+		return fiber.ErrInternalServerError
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(map[string]interface{}{
+		"data": &attachment,
+	})
+}
+
+// thumbnails makes the thumbnails and placeholder of an image attachment
+// once fewer than MaxThumbnailJobs are being made. It fails with
+// fiber.ErrServiceUnavailable if no job finishes within thumbnailWait. A
+// decoder panicking on a malformed image fails like one returning an error.
+func (h *Hub) thumbnails(attachment *Attachment, r io.Reader) (files [][]byte, err error) {
+	select {
+	case h.thumbnailing <- struct{}{}:
+	case <-time.After(thumbnailWait):
+		return nil, fiber.ErrServiceUnavailable
+	}
+	defer func() {
+		<-h.thumbnailing
+		if p := recover(); p != nil {
+			attachment.Thumbnails, attachment.Placeholder = nil, ""
+			files, err = nil, fmt.Errorf("thumbnails of %s: %v", attachment.ID, p)
+		}
+	}()
+
+	attachment.Thumbnails, files, attachment.Placeholder, err = thumbnails(attachment.ID, r)
+	return files, err
+}
+
+// ServeAttachment sends the file of an attachment to its uploader or, once
+// it is sent, to whoever can read the room. Browsers can not put a header on
+// an image, so the token may come in the query instead.
+//
+//	GET /api/attachments/:id?token=...
+func (h *Hub) ServeAttachment(c *fiber.Ctx) error {
+	userID, err := h.bearer(c)
+	if err != nil {
+		return err
+	}
+
+	attachment, err := h.downloadable(userID, c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	file, err := h.attachment.Open(attachment)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fiber.ErrNotFound
+		}
+		log.Printf("%#v\n", err)
+		return fiber.ErrInternalServerError
+	}
+
+	disposition := "attachment"
+	if contains(inlineTypes, attachment.MimeType) {
+		disposition = "inline"
+	}
+	c.Set(fiber.HeaderContentType, attachment.MimeType)
+	c.Set(fiber.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendStream(file, int(attachment.Size))
+}
+
+// ServeThumbnail sends a thumbnail of an image attachment to whoever may
+// download the attachment.
+//
+//	GET /api/attachments/:id/thumbnails/:size?token=...
+func (h *Hub) ServeThumbnail(c *fiber.Ctx) error {
+	userID, err := h.bearer(c)
+	if err != nil {
+		return err
+	}
+
+	attachment, err := h.downloadable(userID, c.Params("id"))
+	if err != nil {
+		return err
+	}
+	var thumbnail *Thumbnail
+	for i := range attachment.Thumbnails {
+		if attachment.Thumbnails[i].Size == thumbnailSize(c.Params("size")) {
+			thumbnail = &attachment.Thumbnails[i]
+		}
+	}
+	if thumbnail == nil {
+		return fiber.ErrNotFound
+	}
+
+	file, err := h.attachment.OpenThumbnail(attachment, thumbnail.Size)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fiber.ErrNotFound
+		}
+		log.Printf("%#v\n", err)
+		return fiber.ErrInternalServerError
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		log.Printf("%#v\n", err)
+		return fiber.ErrInternalServerError
+	}
+
+	c.Set(fiber.HeaderContentType, thumbnail.MimeType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=86400")
+	return c.SendStream(file, int(info.Size()))
+}
+
+// downloadable loads an attachment userID may download: its own, or one
+// sent to a room userID can read. Attachments of deleted messages are
+// removed, so they are not found.
+func (h *Hub) downloadable(userID string, id string) (attachment Attachment, err error) {
+	attachment, ok := h.attachment.Load(id)
+	if !ok {
+		return attachment, fiber.ErrNotFound
+	}
+	if attachment.UserID == userID {
+		return attachment, nil
+	}
+	if attachment.RoomID == "" {
+		return attachment, fiber.ErrNotFound // not shared yet
+	}
+	room, ok := h.room.Room(attachment.RoomID)
+	if !ok {
+		return attachment, fiber.ErrNotFound
+	}
+	if room.Type == DirectRoom && !contains(room.Members, userID) {
+		return attachment, fiber.ErrForbidden
+	}
+	return attachment, nil
+}
+
+// attachments reads the optional ids in the attachments of a request body
+// and returns the attachments, now sent to roomID. Only the uploader can
+// send an attachment.
+// attachmentCount returns how many files a request sends, before they are
+// checked by attachments.
+func attachmentCount(req *Request) int {
+	ids, _ := req.Body["attachments"].([]interface{})
+	return len(ids)
+}
+
+func (h *Hub) attachments(req *Request, roomID string) ([]Attachment, error) {
+	tmp, ok := req.Body["attachments"]
+	if !ok || tmp == nil {
+		return nil, nil
+	}
+	ids, ok := tmp.([]interface{})
+	if !ok || len(ids) > MaxAttachmentsPerMessage {
+		return nil, fiber.ErrBadRequest
+	}
+
+	var attachments []Attachment
+	for _, tmp := range ids {
+		id, ok := tmp.(string)
+		if !ok {
+			return nil, fiber.ErrBadRequest
+		}
+		attachment, ok := h.attachment.Load(id)
+		if !ok || attachment.UserID != req.ClientID {
+			return nil, fiber.ErrNotFound
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	// Checked all before sending any, so a bad id sends none
+	for i, attachment := range attachments {
+		attachment, ok := h.attachment.Attach(attachment.ID, roomID)
+		if !ok {
+			return nil, fiber.NewError(fiber.StatusConflict, "attachment was sent to another room")
+		}
+		attachments[i] = attachment
+	}
+	return attachments, nil
+}
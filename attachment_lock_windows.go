@@ -0,0 +1,13 @@
+package main
+
+import "sync"
+
+// dirLock stands in for flock, prefork is not supported on windows so
+// excluding the other goroutines is enough.
+var dirLock sync.Mutex
+
+// lockDir takes an exclusive lock on a directory until unlock is called.
+func lockDir(dir string) (unlock func(), err error) {
+	dirLock.Lock()
+	return dirLock.Unlock, nil
+}
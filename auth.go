@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+	MinPasswordLength = 8
+	MaxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+// ErrAccountsUnavailable refuses accounts with storage that would lose them
+// on restart, e.g. leaving tokens that verify but belong to nobody.
+var ErrAccountsUnavailable = fiber.NewError(fiber.StatusNotImplemented, "accounts need the bolt storage driver")
+
+// dummyHash is compared against when no account has the username, so a
+// login takes as long whether the account exists or not.
+var dummyHash = []byte("$2a$10$P87xpSpLyZv00f9wfDrxVubDoIIvvhecMS6oG3an87FaKnle70AAS")
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *Credentials) validate() error {
+	c.Username = strings.TrimSpace(c.Username)
+	if l := len(c.Username); l < MinUsernameLength || l > MaxUsernameLength {
+		return fiber.NewError(fiber.StatusBadRequest, "username must be 3 to 32 characters")
+	}
+	if l := len(c.Password); l < MinPasswordLength || l > MaxPasswordLength {
+		return fiber.NewError(fiber.StatusBadRequest, "password must be 8 to 72 characters")
+	}
+	return nil
+}
+
+// RegisterAccount creates an account and returns a token to connect with.
+//
+//	POST /api/auth/register {"username": "...", "password": "..."}
+func (h *Hub) RegisterAccount(c *fiber.Ctx) error {
+	if h.Options.Storage.Driver != BoltDriver {
+		return ErrAccountsUnavailable
+	}
+
+	var creds Credentials
+	if err := c.BodyParser(&creds); err != nil {
+		return fiber.ErrBadRequest
+	}
+	if err := creds.validate(); err != nil {
+		return err
+	}
+
+	if _, ok := h.user.FindAccount(creds.Username); ok {
+		return fiber.NewError(fiber.StatusConflict, "username is taken")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return fiber.ErrInternalServerError
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fiber.ErrInternalServerError
+	}
+
+	account := Account{
+		ID:           id.String(),
+		Username:     creds.Username,
+		Avatar:       "https://picsum.photos/56/56", // TODO: create a default avatar to use
+		PasswordHash: hash,
+	}
+	if ok := h.user.StoreAccount(account); !ok {
+		return fiber.NewError(fiber.StatusConflict, "username is taken")
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_ACCOUNT_STORED,
+		Account: &account,
+	})
+
+	return h.authenticated(c.Status(fiber.StatusCreated), account)
+}
+
+// Login checks the password of an account and returns a token to connect with.
+//
+//	POST /api/auth/login {"username": "...", "password": "..."}
+func (h *Hub) Login(c *fiber.Ctx) error {
+	if h.Options.Storage.Driver != BoltDriver {
+		return ErrAccountsUnavailable
+	}
+
+	var creds Credentials
+	if err := c.BodyParser(&creds); err != nil {
+		return fiber.ErrBadRequest
+	}
+
+	account, ok := h.user.FindAccount(strings.TrimSpace(creds.Username))
+	hash := account.PasswordHash
+	if !ok {
+		hash = dummyHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(creds.Password)); !ok || err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid username or password")
+	}
+
+	return h.authenticated(c, account)
+}
+
+func (h *Hub) authenticated(c *fiber.Ctx, account Account) error {
+	return c.JSON(map[string]interface{}{
+		"token": NewTokenSigner(h.Options.Secret).Sign(AuthToken, account.ID, time.Now().Add(h.Options.TokenTTL)),
+		"data": User{
+			ID:       account.ID,
+			Username: account.Username,
+			Avatar:   account.Avatar,
+		},
+	})
+}
+
+// bearer returns the user an API request is made by, from an
+// "Authorization: Bearer <token>" header holding an auth token, or the resume
+// token of a connected user. Without the header the token is read from the
+// query, for requests the browser makes by itself like loading an image.
+func (h *Hub) bearer(c *fiber.Ctx) (userID string, err error) {
+	token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+
+	if userID, err := NewTokenSigner(h.Options.Secret).Verify(AuthToken, token); err == nil {
+		if _, ok := h.user.LoadAccount(userID); !ok {
+			return "", fiber.ErrUnauthorized
+		}
+		return userID, nil
+	}
+	if userID, ok := h.resume(token); ok {
+		return userID, nil
+	}
+	return "", fiber.ErrUnauthorized
+}
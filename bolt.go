@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltSchemaVersion is the on-disk layout version written to the meta bucket.
+// Bump it together with a new entry in boltMigrations.
+const boltSchemaVersion = 7
+
+var (
+	boltMetaBucket         = []byte("meta")
+	boltRoomsBucket        = []byte("rooms")
+	boltMessagesBucket     = []byte("messages")
+	boltMessageIDsBucket   = []byte("message_ids")
+	boltAccountsBucket     = []byte("accounts")
+	boltAccountNamesBucket = []byte("account_names")
+	boltProfilesBucket     = []byte("profiles")
+	boltRevisionsBucket    = []byte("message_revisions")
+	boltMentionsBucket     = []byte("message_mentions")
+	boltReadsBucket        = []byte("message_reads")
+	boltWordsBucket        = []byte("message_words")
+
+	boltVersionKey = []byte("version")
+)
+
+// boltMigrations[i] upgrades a database from schema version i to i+1.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 0 -> 1: initial layout with the default topic rooms
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{
+			boltRoomsBucket,
+			boltMessagesBucket,
+			boltMessageIDsBucket,
+		} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		rooms := tx.Bucket(boltRoomsBucket)
+		for id, room := range defaultRooms() {
+			if err := putJSON(rooms, []byte(id), room); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 1 -> 2: registered accounts, indexed by lowercase username
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltAccountsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltAccountNamesBucket)
+		return err
+	},
+	// 2 -> 3: profiles outlive the connections of their users
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltProfilesBucket)
+		return err
+	},
+	// 3 -> 4: earlier texts of edited messages, per room
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltRevisionsBucket)
+		return err
+	},
+	// 4 -> 5: messages mentioning each user
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltMentionsBucket)
+		return err
+	},
+	// 5 -> 6: read positions, per room
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltReadsBucket)
+		return err
+	},
+	// 6 -> 7: search index of the messages stored so far
+	func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltWordsBucket); err != nil {
+			return err
+		}
+		return tx.Bucket(boltMessagesBucket).ForEach(func(roomID, _ []byte) error {
+			room := tx.Bucket(boltMessagesBucket).Bucket(roomID)
+			if room == nil {
+				return nil
+			}
+			return room.ForEach(func(seq, v []byte) error {
+				var message Message
+				if err := json.Unmarshal(v, &message); err != nil {
+					return err
+				}
+				return boltIndex(tx, string(roomID), seq, message.Message, false)
+			})
+		})
+	},
+}
+
+// BoltStorage is a single-file embedded database shared by the bolt backed
+// user, room and message stores.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	// bolt locks the file, so fail instead of blocking forever if another
+	// process already has it open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &BoltStorage{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStorage) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := 0
+		if v := meta.Get(boltVersionKey); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("bolt: invalid schema version %q", v)
+			}
+		}
+		if version > boltSchemaVersion {
+			return fmt.Errorf("bolt: schema version %d is newer than supported version %d", version, boltSchemaVersion)
+		}
+
+		for ; version < boltSchemaVersion; version++ {
+			if err := boltMigrations[version](tx); err != nil {
+				return err
+			}
+		}
+		return meta.Put(boltVersionKey, []byte(strconv.Itoa(version)))
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStorage) UserStore() *BoltUserStore {
+	return &BoltUserStore{
+		db:       s.db,
+		users:    map[string]User{},
+		profiles: map[string]User{},
+	}
+}
+
+func (s *BoltStorage) RoomStore() *BoltRoomStore {
+	return &BoltRoomStore{
+		db:        s.db,
+		users:     map[string][]string{},
+		userRooms: map[string]Room{},
+	}
+}
+
+func (s *BoltStorage) MessageStore() *BoltMessageStore {
+	return &BoltMessageStore{db: s.db}
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
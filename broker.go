@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Event is what a hub publishes so hubs in other processes can mirror the
+// change and inform their own connections.
+type Event struct {
+	Node     string    `json:"node"`
+	Type     EventType `json:"type"`
+	RoomID   string    `json:"roomId,omitempty"`
+	RoomIDs  []string  `json:"roomIds,omitempty"`
+	User     *User     `json:"user,omitempty"`
+	Message  *Message  `json:"message,omitempty"`
+	Account  *Account  `json:"account,omitempty"`
+	Room     *Room     `json:"room,omitempty"`
+	Reaction *Reaction `json:"reaction,omitempty"`
+}
+
+type EventType int
+
+const (
+	EVENT_JOINED_CHAT EventType = iota
+	EVENT_LEFT_CHAT
+	EVENT_DISCONNECTED
+	EVENT_CHANGED_USERNAME
+	EVENT_MESSAGE_SEND
+	EVENT_RESUMED
+	EVENT_ACCOUNT_STORED
+	EVENT_ROOM_CREATED
+	EVENT_ROOM_RENAMED
+	EVENT_ROOM_DELETED
+	EVENT_DIRECT_MESSAGE_SEND
+	EVENT_MESSAGE_EDITED
+	EVENT_MESSAGE_DELETED
+	EVENT_REACTION_CHANGED
+	EVENT_TYPING_STARTED
+	EVENT_TYPING_STOPPED
+	EVENT_READ_POSITION
+	EVENT_PRESENCE_CHANGED
+)
+
+func (t EventType) String() string {
+	return []string{
+		"EVENT_JOINED_CHAT",
+		"EVENT_LEFT_CHAT",
+		"EVENT_DISCONNECTED",
+		"EVENT_CHANGED_USERNAME",
+		"EVENT_MESSAGE_SEND",
+		"EVENT_RESUMED",
+		"EVENT_ACCOUNT_STORED",
+		"EVENT_ROOM_CREATED",
+		"EVENT_ROOM_RENAMED",
+		"EVENT_ROOM_DELETED",
+		"EVENT_DIRECT_MESSAGE_SEND",
+		"EVENT_MESSAGE_EDITED",
+		"EVENT_MESSAGE_DELETED",
+		"EVENT_REACTION_CHANGED",
+		"EVENT_TYPING_STARTED",
+		"EVENT_TYPING_STOPPED",
+		"EVENT_READ_POSITION",
+		"EVENT_PRESENCE_CHANGED",
+	}[t]
+}
+
+// Broker fans events out to every subscriber, including the publisher itself.
+// Subscribers are expected to skip events carrying their own Node.
+type Broker interface {
+	Publish(event Event) error
+	Subscribe() <-chan Event
+	Close() error
+}
+
+// brokerBufferSize is how many events may wait for a subscriber before new
+// ones are dropped.
+const brokerBufferSize = 1024
+
+// InProcessBroker connects hubs living in the same process.
+type InProcessBroker struct {
+	sync.Mutex
+	subscribers []chan Event
+}
+
+var _ Broker = (*InProcessBroker)(nil)
+
+func NewInProcessBroker() *InProcessBroker {
+	return &InProcessBroker{}
+}
+
+func (b *InProcessBroker) Publish(event Event) error {
+	b.Lock()
+	for _, sub := range b.subscribers {
+		select {
+		case sub <- event:
+		default:
+			log.Printf("broker: subscriber is full, dropping %v\n", event.Type)
+		}
+	}
+	b.Unlock()
+	return nil
+}
+
+func (b *InProcessBroker) Subscribe() <-chan Event {
+	sub := make(chan Event, brokerBufferSize)
+	b.Lock()
+	b.subscribers = append(b.subscribers, sub)
+	b.Unlock()
+	return sub
+}
+
+func (b *InProcessBroker) Close() error {
+	b.Lock()
+	for _, sub := range b.subscribers {
+		close(sub)
+	}
+	b.subscribers = nil
+	b.Unlock()
+	return nil
+}
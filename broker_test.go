@@ -0,0 +1,181 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenRelay(t *testing.T) (*UnixBrokerRelay, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "broker.sock")
+	relay, err := ListenUnixBroker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay, path
+}
+
+func dialBroker(t *testing.T, path string) *UnixBroker {
+	t.Helper()
+	broker, err := DialUnixBroker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event arrived")
+		return Event{}
+	}
+}
+
+func TestUnixBrokerFansOut(t *testing.T) {
+	_, path := listenRelay(t)
+
+	var brokers []*UnixBroker
+	for i := 0; i < 3; i++ {
+		brokers = append(brokers, dialBroker(t, path))
+	}
+	// Every broker has to be connected before anything is published
+	time.Sleep(100 * time.Millisecond)
+
+	nodes := []string{"a", "b", "c"}
+	for i, broker := range brokers {
+		if err := broker.Publish(Event{Node: nodes[i], Type: EVENT_MESSAGE_SEND, RoomID: "room"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The publisher gets its own events too
+	for i, broker := range brokers {
+		seen := map[string]bool{}
+		for range nodes {
+			event := receive(t, broker.Subscribe())
+			if event.Type != EVENT_MESSAGE_SEND || event.RoomID != "room" {
+				t.Fatalf("broker %d got %+v", i, event)
+			}
+			seen[event.Node] = true
+		}
+		for _, node := range nodes {
+			if !seen[node] {
+				t.Errorf("broker %d missed the event of %s", i, node)
+			}
+		}
+	}
+}
+
+func TestUnixBrokerSkipsOwnEvents(t *testing.T) {
+	_, path := listenRelay(t)
+
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		hub := NewHub()
+		if err := hub.Defaults(StorageOptions{Driver: MemoryDriver, AttachmentDir: t.TempDir()}); err != nil {
+			t.Fatal(err)
+		}
+		hub.Broker = dialBroker(t, path)
+		hubs = append(hubs, hub)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The room only exists in the event, so only a hub applying it has it
+	room := Room{ID: "room", Name: "relayed", Type: TopicRoom}
+	hubs[0].publish(Event{Type: EVENT_ROOM_CREATED, Room: &room})
+
+	for _, hub := range hubs {
+		event := receive(t, hub.Broker.Subscribe())
+		if event.Node != hubs[0].node {
+			t.Fatalf("event of node %s, want %s", event.Node, hubs[0].node)
+		}
+		hub.remote_event(event)
+	}
+
+	if _, ok := hubs[0].room.Room(room.ID); ok {
+		t.Error("publisher applied its own event")
+	}
+	if _, ok := hubs[1].room.Room(room.ID); !ok {
+		t.Error("other node did not apply the event")
+	}
+}
+
+func TestUnixBrokerRedials(t *testing.T) {
+	relay, path := listenRelay(t)
+	publisher, subscriber := dialBroker(t, path), dialBroker(t, path)
+	time.Sleep(100 * time.Millisecond)
+
+	// A new relay on the same path, as after the master restarted
+	relay.Close()
+	relay, err := ListenUnixBroker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	// Events written before the brokers notice the old relay is gone are
+	// lost, so keep publishing until one comes through
+	deadline := time.After(10 * time.Second)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case event := <-subscriber.Subscribe():
+			if event.Node != "publisher" {
+				t.Fatalf("got %+v", event)
+			}
+			return
+		case <-tick.C:
+			if err := publisher.Publish(Event{Node: "publisher", Type: EVENT_ROOM_RENAMED}); err != nil {
+				t.Fatal(err)
+			}
+		case <-deadline:
+			t.Fatal("brokers did not reconnect")
+		}
+	}
+}
+
+func TestUnixBrokerRelayDropsStalledPeer(t *testing.T) {
+	_, path := listenRelay(t)
+	broker := dialBroker(t, path)
+
+	// A peer that never reads
+	stalled, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Enough to fill its queue and the socket buffers, none may be lost for
+	// the peer reading
+	const n = 20000
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := broker.Publish(Event{Node: "node", Type: EVENT_MESSAGE_SEND, RoomID: strings.Repeat("r", 64)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		receive(t, broker.Subscribe())
+	}
+
+	// The stalled peer was dropped, it reads what was buffered and then EOF
+	stalled.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, stalled); err != nil {
+		t.Fatalf("stalled peer was not dropped: %v", err)
+	}
+}
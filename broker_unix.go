@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Events travel as newline delimited JSON. maxEventSize bounds a single
+	// line.
+	maxEventSize = 1 << 20
+	// brokerSendTimeout is how long a relay waits for room in the queue of a
+	// peer before it drops the peer, which redials.
+	brokerSendTimeout = time.Second
+	// brokerPublishTimeout is how long a broker waits for room in its queue
+	// before it fails to publish, longer than a relay takes to drop a stalled
+	// peer holding it up.
+	brokerPublishTimeout = 5 * brokerSendTimeout
+)
+
+var (
+	ErrBrokerClosed = errors.New("broker: closed")
+	ErrBrokerBusy   = errors.New("broker: relay does not keep up")
+)
+
+// UnixBrokerRelay listens on a unix socket and forwards every event line it
+// reads to all connected UnixBrokers, the sender included. In prefork mode the
+// master process runs the relay and every child dials it.
+type UnixBrokerRelay struct {
+	sync.Mutex
+	listener net.Listener
+	peers    map[net.Conn]*relayPeer
+}
+
+// relayPeer is a connected UnixBroker and the lines waiting to be written to
+// it.
+type relayPeer struct {
+	conn net.Conn
+	out  chan []byte
+	gone chan struct{}
+	once sync.Once
+}
+
+// close drops the peer, lines sent to it from then on are discarded.
+func (p *relayPeer) close() {
+	p.once.Do(func() {
+		close(p.gone)
+		p.conn.Close()
+	})
+}
+
+// send queues line for the peer. A peer not keeping up is dropped rather than
+// missing events, it redials and starts over.
+func (p *relayPeer) send(line []byte) {
+	select {
+	case p.out <- line:
+		return
+	case <-p.gone:
+		return
+	default:
+	}
+
+	t := time.NewTimer(brokerSendTimeout)
+	defer t.Stop()
+	select {
+	case p.out <- line:
+	case <-p.gone:
+	case <-t.C:
+		log.Printf("broker: %s is full, dropping it\n", p.conn.RemoteAddr())
+		p.close()
+	}
+}
+
+func ListenUnixBroker(path string) (*UnixBrokerRelay, error) {
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &UnixBrokerRelay{
+		listener: l,
+		peers:    map[net.Conn]*relayPeer{},
+	}
+	go r.accept()
+	return r, nil
+}
+
+func (r *UnixBrokerRelay) Close() error {
+	err := r.listener.Close()
+	r.Lock()
+	for _, peer := range r.peers {
+		peer.close()
+	}
+	r.Unlock()
+	return err
+}
+
+func (r *UnixBrokerRelay) accept() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return // listener is closed
+		}
+
+		peer := &relayPeer{
+			conn: conn,
+			out:  make(chan []byte, brokerBufferSize),
+			gone: make(chan struct{}),
+		}
+		r.Lock()
+		r.peers[conn] = peer
+		r.Unlock()
+
+		go r.write(peer)
+		go r.read(peer)
+	}
+}
+
+func (r *UnixBrokerRelay) read(peer *relayPeer) {
+	defer func() {
+		r.Lock()
+		delete(r.peers, peer.conn)
+		r.Unlock()
+		peer.close()
+	}()
+
+	scanner := bufio.NewScanner(peer.conn)
+	scanner.Buffer(make([]byte, 4096), maxEventSize)
+	for scanner.Scan() {
+		line := append(append([]byte{}, scanner.Bytes()...), '\n')
+
+		// Sent outside the lock, a full peer only holds up its sender
+		r.Lock()
+		peers := make([]*relayPeer, 0, len(r.peers))
+		for _, p := range r.peers {
+			peers = append(peers, p)
+		}
+		r.Unlock()
+
+		for _, p := range peers {
+			p.send(line)
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("%#v\n", err)
+	}
+}
+
+func (r *UnixBrokerRelay) write(peer *relayPeer) {
+	for {
+		select {
+		case line := <-peer.out:
+			if _, err := peer.conn.Write(line); err != nil {
+				peer.close()
+				return
+			}
+		case <-peer.gone:
+			return
+		}
+	}
+}
+
+// UnixBroker is a Broker talking to a UnixBrokerRelay. It redials the relay if
+// the connection drops; events published meanwhile are queued up to
+// brokerBufferSize.
+type UnixBroker struct {
+	path   string
+	events chan Event
+	out    chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+var _ Broker = (*UnixBroker)(nil)
+
+func DialUnixBroker(path string) (*UnixBroker, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	// The relay may still be starting, give it a few tries
+	for i := 0; i < 10; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &UnixBroker{
+		path:   path,
+		events: make(chan Event, brokerBufferSize),
+		out:    make(chan Event, brokerBufferSize),
+		done:   make(chan struct{}),
+	}
+	go b.run(conn)
+	return b, nil
+}
+
+func (b *UnixBroker) Publish(event Event) error {
+	select {
+	case <-b.done:
+		return ErrBrokerClosed
+	default:
+	}
+
+	select {
+	case b.out <- event:
+		return nil
+	default:
+	}
+
+	// Wait for the relay rather than dropping the event
+	t := time.NewTimer(brokerPublishTimeout)
+	defer t.Stop()
+	select {
+	case b.out <- event:
+		return nil
+	case <-b.done:
+		return ErrBrokerClosed
+	case <-t.C:
+		return ErrBrokerBusy
+	}
+}
+
+func (b *UnixBroker) Subscribe() <-chan Event {
+	return b.events
+}
+
+func (b *UnixBroker) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
+
+func (b *UnixBroker) run(conn net.Conn) {
+	defer close(b.events)
+
+	for {
+		readDone := make(chan struct{})
+		go b.read(conn, readDone)
+		b.write(conn, readDone)
+		conn.Close()
+		<-readDone
+
+		// Redial until the relay is back or the broker is closed
+		for {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+
+			var err error
+			if conn, err = net.Dial("unix", b.path); err == nil {
+				break
+			}
+			log.Printf("%#v\n", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (b *UnixBroker) read(conn net.Conn, readDone chan<- struct{}) {
+	defer close(readDone)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxEventSize)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("%#v\n", err)
+			continue
+		}
+
+		select {
+		case b.events <- event:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *UnixBroker) write(conn net.Conn, readDone <-chan struct{}) {
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case event := <-b.out:
+			if err := enc.Encode(event); err != nil {
+				log.Printf("%#v\n", err)
+				return
+			}
+		case <-readDone:
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -1,7 +1,13 @@
 import { ref } from 'vue';
 import randomId from '../utils/randomId';
 import useWebSocket from './useWebSocket';
-import useChatState, { IMessage, MessageType } from './useChatState';
+import useChatState, {
+  IAttachment,
+  IMessage,
+  IUser,
+  MessageType,
+  Presence
+} from './useChatState';
 
 enum ResponseEvents {
   ERROR,
@@ -15,7 +21,27 @@ enum ResponseEvents {
   OTHER_LEFT_CHAT,
   ME_MESSAGE_SEND,
   OTHER_MESSAGE_SEND,
-  OLD_MESSAGES
+  OLD_MESSAGES,
+  ROOMS_CHANGED,
+  DM_OPENED,
+  ME_DIRECT_MESSAGE_SEND,
+  OTHER_DIRECT_MESSAGE_SEND,
+  DIRECT_ROOMS,
+  UNREAD_COUNTS,
+  MESSAGE_EDITED,
+  MESSAGE_REVISIONS,
+  MESSAGE_DELETED,
+  REACTION_CHANGED,
+  THREAD_REPLY,
+  THREAD_MESSAGES,
+  MENTIONED,
+  MENTIONS,
+  USER_TYPING,
+  READ_POSITION,
+  PRESENCE_CHANGED,
+  SEARCH_RESULTS,
+  MESSAGES_AROUND,
+  NEWER_MESSAGES
 }
 
 enum RequestEvents {
@@ -24,7 +50,28 @@ enum RequestEvents {
   JOIN_CHAT,
   LEFT_CHAT,
   SEND_MESSAGE,
-  GET_OLD_MESSAGES
+  GET_OLD_MESSAGES,
+  CREATE_ROOM,
+  RENAME_ROOM,
+  DELETE_ROOM,
+  OPEN_DM,
+  SEND_DIRECT_MESSAGE,
+  GET_DIRECT_ROOMS,
+  FOCUS_ROOM,
+  EDIT_MESSAGE,
+  GET_MESSAGE_REVISIONS,
+  DELETE_MESSAGE,
+  ADD_REACTION,
+  REMOVE_REACTION,
+  GET_THREAD,
+  GET_MENTIONS,
+  TYPING_START,
+  TYPING_STOP,
+  MARK_READ,
+  SET_PRESENCE,
+  SEARCH_MESSAGES,
+  GET_MESSAGES_AROUND,
+  GET_NEWER_MESSAGES
 }
 
 const url = ref('ws://localhost:8080/ws/chat');
@@ -34,10 +81,18 @@ const isConnecting = ref(false);
 export default function useChat() {
   const {
     rooms,
+    directRooms,
+    unread,
+    mentions,
+    typing,
+    reads,
+    search,
+    jump,
     currentRoom,
     me,
     messageInput,
     messages,
+    thread,
     users
   } = useChatState();
 
@@ -46,13 +101,19 @@ export default function useChat() {
 
     const { connect, connections } = useWebSocket();
 
+    // Send the resume token so a reconnect keeps the same user
+    const token = window.sessionStorage.getItem('token');
+    const chatUrl = token
+      ? `${url.value}?token=${encodeURIComponent(token)}`
+      : url.value;
+
     isConnecting.value = true;
-    await connect(url.value)
+    await connect(chatUrl)
       .catch(err => console.error(err))
       .catch(() => connectChat())
       .finally(() => (isConnecting.value = false));
 
-    ws.value = connections.value.get(url.value);
+    ws.value = connections.value.get(chatUrl);
 
     addListener(ws.value);
   }
@@ -76,12 +137,19 @@ export default function useChat() {
         case ResponseEvents.ERROR:
           console.log('wsChat(message): ResponseEvents.ERROR:');
           console.log(JSON.stringify(res, null, 2));
+          // Older messages were trimmed, there is nothing more to load
+          if (res.error?.message === 'cursor expired' && currentRoom.value) {
+            currentRoom.value.doneLoading = true;
+          }
           break;
 
         case ResponseEvents.CONNECTED:
           console.log('wsChat(message): ResponseEvents.CONNECTED:');
           getRooms();
           me.value = res.body.data;
+          if (res.body.token) {
+            window.sessionStorage.setItem('token', res.body.token);
+          }
           const username = window.localStorage.getItem('username');
           if (username) {
             changeUsername(username);
@@ -93,6 +161,9 @@ export default function useChat() {
           if (res.body && res.body.data) {
             rooms.value = res.body.data;
           }
+          if (res.body && res.body.unread) {
+            unread.value = { ...unread.value, ...res.body.unread };
+          }
           break;
 
         case ResponseEvents.ME_CHANGED_USERNAME:
@@ -150,12 +221,18 @@ export default function useChat() {
             );
             messages.value = res.body.data.messages;
           }
+          jump.value = undefined;
           if (res.body.data.users) {
             users.value = res.body.data.users;
           }
           if (res.body.data.room) {
             currentRoom.value = res.body.data.room;
           }
+          if (currentRoom.value) {
+            currentRoom.value.nextCursor = res.body.data.nextCursor;
+            currentRoom.value.doneLoading = !res.body.data.nextCursor;
+          }
+          reads.value = res.body.data.reads || {};
           // messages.value.push({
           //   id: randomId(),
           //   message: res.body.message,
@@ -177,6 +254,7 @@ export default function useChat() {
 
         case ResponseEvents.OTHER_JOINED_CHAT:
           console.log('wsChat(message): ResponseEvents.OTHER_JOINED_CHAT:');
+          if (currentRoom.value?.id !== res.body.roomId) break;
           users.value.push(res.body.data);
           // messages.value.push({
           //   id: randomId(),
@@ -205,6 +283,7 @@ export default function useChat() {
 
         case ResponseEvents.OTHER_LEFT_CHAT:
           console.log('wsChat(message): ResponseEvents.OTHER_LEFT_CHAT:');
+          if (currentRoom.value?.id !== res.body.roomId) break;
           users.value = users.value.filter(
             user => user.id !== res.body.data.id
           );
@@ -237,6 +316,9 @@ export default function useChat() {
 
         case ResponseEvents.OTHER_MESSAGE_SEND:
           console.log('wsChat(message): ResponseEvents.OTHER_MESSAGE_SEND:');
+          if (currentRoom.value?.id !== res.body.data.roomId) break;
+          // Not next to the messages of a window in the past
+          if (jump.value?.hasNewer) break;
           res.body.data.type = MessageType.NEW_MESSAGE;
           // messages.value.push(res.body.data);
           messages.value = [...messages.value, res.body.data];
@@ -250,11 +332,220 @@ export default function useChat() {
             );
             // messages.value.unshift(...res.body.data.messages);
             messages.value = [...res.body.data.messages, ...messages.value];
-          } else {
-            if (currentRoom.value) {
-              currentRoom.value.doneLoading = true;
+          }
+          if (currentRoom.value) {
+            currentRoom.value.nextCursor = res.body.data.nextCursor;
+            currentRoom.value.doneLoading = !res.body.data.nextCursor;
+          }
+          break;
+
+        case ResponseEvents.ROOMS_CHANGED:
+          console.log('wsChat(message): ResponseEvents.ROOMS_CHANGED:');
+          rooms.value = res.body.data || [];
+          if (
+            currentRoom.value &&
+            currentRoom.value.id === res.body.room.id &&
+            'name' in currentRoom.value
+          ) {
+            currentRoom.value.name = res.body.room.name;
+          }
+          break;
+
+        case ResponseEvents.DM_OPENED:
+          console.log('wsChat(message): ResponseEvents.DM_OPENED:');
+          currentRoom.value = {
+            ...res.body.data.room,
+            nextCursor: res.body.data.nextCursor,
+            doneLoading: !res.body.data.nextCursor
+          };
+          users.value = [res.body.data.user];
+          messages.value = (res.body.data.messages || []).map(
+            (msg: IMessage) => ({ ...msg, type: MessageType.NEW_MESSAGE })
+          );
+          break;
+
+        case ResponseEvents.ME_DIRECT_MESSAGE_SEND:
+        case ResponseEvents.OTHER_DIRECT_MESSAGE_SEND:
+          console.log('wsChat(message): ResponseEvents.DIRECT_MESSAGE_SEND:');
+          res.body.data.type = MessageType.NEW_MESSAGE;
+          if (currentRoom.value?.id === res.body.data.roomId) {
+            messages.value = [...messages.value, res.body.data];
+          }
+          getDirectRooms();
+          break;
+
+        case ResponseEvents.DIRECT_ROOMS:
+          console.log('wsChat(message): ResponseEvents.DIRECT_ROOMS:');
+          directRooms.value = res.body.data || [];
+          break;
+
+        case ResponseEvents.UNREAD_COUNTS:
+          console.log('wsChat(message): ResponseEvents.UNREAD_COUNTS:');
+          unread.value = { ...unread.value, ...res.body.data };
+          break;
+
+        case ResponseEvents.MESSAGE_EDITED:
+        case ResponseEvents.MESSAGE_DELETED: {
+          console.log('wsChat(message): ResponseEvents.MESSAGE_UPDATED:');
+          const deleted = res.type === ResponseEvents.MESSAGE_DELETED;
+          messages.value = messages.value.map(msg => {
+            if (msg.id === res.body.data.id) {
+              return { ...res.body.data, type: MessageType.NEW_MESSAGE };
+            }
+            // Quotes of a deleted message lose their excerpt, as on the server
+            if (deleted && msg.replyTo?.id === res.body.data.id) {
+              return {
+                ...msg,
+                replyTo: { ...msg.replyTo, excerpt: '', deleted: true }
+              };
             }
+            return msg;
+          });
+          break;
+        }
+
+        case ResponseEvents.REACTION_CHANGED: {
+          console.log('wsChat(message): ResponseEvents.REACTION_CHANGED:');
+          const { messageId, emoji, userIds } = res.body.data;
+          messages.value = messages.value.map(msg => {
+            if (msg.id !== messageId) return msg;
+            const reactions = { ...msg.reactions };
+            if (userIds?.length) reactions[emoji] = userIds;
+            else delete reactions[emoji];
+            return { ...msg, reactions };
+          });
+          break;
+        }
+
+        case ResponseEvents.THREAD_REPLY: {
+          console.log('wsChat(message): ResponseEvents.THREAD_REPLY:');
+          const reply = { ...res.body.data, type: MessageType.NEW_MESSAGE };
+          messages.value = messages.value.map(msg =>
+            msg.id === reply.parentId
+              ? { ...msg, replyCount: res.body.replyCount }
+              : msg
+          );
+          if (thread.value?.parent.id === reply.parentId) {
+            thread.value = {
+              parent: { ...thread.value.parent, replyCount: res.body.replyCount },
+              messages: [...thread.value.messages, reply]
+            };
+          }
+          break;
+        }
+
+        case ResponseEvents.THREAD_MESSAGES: {
+          console.log('wsChat(message): ResponseEvents.THREAD_MESSAGES:');
+          const { parent, messages: replies } = res.body.data;
+          const older = (replies || []).map((msg: IMessage) => ({
+            ...msg,
+            type: MessageType.NEW_MESSAGE
+          }));
+          // A page of older replies goes before the ones already shown
+          thread.value = {
+            parent: { ...parent, type: MessageType.NEW_MESSAGE },
+            messages:
+              thread.value?.parent.id === parent.id
+                ? [...older, ...thread.value.messages]
+                : older
+          };
+          break;
+        }
+
+        case ResponseEvents.MENTIONED:
+          console.log('wsChat(message): ResponseEvents.MENTIONED:');
+          mentions.value = [
+            ...mentions.value,
+            { ...res.body.data, type: MessageType.NEW_MESSAGE }
+          ];
+          break;
+
+        case ResponseEvents.MENTIONS:
+          console.log('wsChat(message): ResponseEvents.MENTIONS:');
+          mentions.value = (res.body.data || []).map((msg: IMessage) => ({
+            ...msg,
+            type: MessageType.NEW_MESSAGE
+          }));
+          break;
+
+        case ResponseEvents.USER_TYPING: {
+          console.log('wsChat(message): ResponseEvents.USER_TYPING:');
+          const { roomId, typing: isTyping, data: user } = res.body;
+          const others = (typing.value[roomId] || []).filter(
+            u => u.id !== user.id
+          );
+          typing.value = {
+            ...typing.value,
+            [roomId]: isTyping ? [...others, user] : others
+          };
+          break;
+        }
+
+        case ResponseEvents.PRESENCE_CHANGED: {
+          console.log('wsChat(message): ResponseEvents.PRESENCE_CHANGED:');
+          const user: IUser = res.body.data;
+          if (me.value?.id === user.id) {
+            me.value = user;
           }
+          users.value = users.value.map(u => (u.id === user.id ? user : u));
+          break;
+        }
+
+        case ResponseEvents.SEARCH_RESULTS: {
+          console.log('wsChat(message): ResponseEvents.SEARCH_RESULTS:');
+          const { query, data, hasMore, nextOffset } = res.body;
+          // A later page of the same search adds to the results
+          const earlier =
+            query === search.value.query &&
+            nextOffset - data.length === search.value.nextOffset
+              ? search.value.messages
+              : [];
+          search.value = {
+            query,
+            messages: [...earlier, ...data],
+            hasMore,
+            nextOffset
+          };
+          break;
+        }
+
+        case ResponseEvents.MESSAGES_AROUND: {
+          console.log('wsChat(message): ResponseEvents.MESSAGES_AROUND:');
+          const { room, anchorId, hasOlder, hasNewer } = res.body.data;
+          if (currentRoom.value?.id !== room.id) break;
+          const around: IMessage[] = res.body.data.messages || [];
+          around.map(msg => (msg.type = MessageType.NEW_MESSAGE));
+          messages.value = around;
+          currentRoom.value.nextCursor = res.body.data.nextCursor;
+          currentRoom.value.doneLoading = !hasOlder;
+          jump.value = { anchorId, hasNewer };
+          break;
+        }
+
+        case ResponseEvents.NEWER_MESSAGES: {
+          console.log('wsChat(message): ResponseEvents.NEWER_MESSAGES:');
+          const { room, hasNewer } = res.body.data;
+          if (currentRoom.value?.id !== room.id || !jump.value) break;
+          const newer: IMessage[] = res.body.data.messages || [];
+          newer.map(msg => (msg.type = MessageType.NEW_MESSAGE));
+          messages.value = [...messages.value, ...newer];
+          // Caught up with the latest messages, live ones append again
+          jump.value = hasNewer ? { ...jump.value, hasNewer } : undefined;
+          break;
+        }
+
+        case ResponseEvents.READ_POSITION:
+          console.log('wsChat(message): ResponseEvents.READ_POSITION:');
+          if (currentRoom.value?.id !== res.body.roomId) break;
+          reads.value = {
+            ...reads.value,
+            [res.body.data.id]: res.body.messageId
+          };
+          break;
+
+        case ResponseEvents.MESSAGE_REVISIONS:
+          console.log('wsChat(message): ResponseEvents.MESSAGE_REVISIONS:');
+          console.log(JSON.stringify(res, null, 2));
           break;
 
         default:
@@ -331,8 +622,20 @@ export default function useChat() {
     }
   }
 
-  function sendMessage(msg: string, roomId: string | (string | null)[]) {
-    if (!roomId || !msg || ws.value?.readyState !== ws.value?.OPEN) return;
+  // Attachments are the ids uploadAttachment returned
+  function sendMessage(
+    msg: string,
+    roomId: string | (string | null)[],
+    parentId?: string,
+    replyToId?: string,
+    attachments?: string[]
+  ) {
+    if (
+      !roomId ||
+      (!msg && !attachments?.length) ||
+      ws.value?.readyState !== ws.value?.OPEN
+    )
+      return;
 
     try {
       ws.value?.send(
@@ -340,10 +643,131 @@ export default function useChat() {
           type: RequestEvents.SEND_MESSAGE,
           body: {
             message: msg,
+            roomId,
+            parentId,
+            replyToId,
+            attachments
+          }
+        })
+      );
+
+      messageInput.value = '';
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // The cursor comes with the previous page, clients must not build it
+  function getOldMessages(roomId: string | (string | null)[], cursor: string) {
+    if (!roomId || !cursor) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_OLD_MESSAGES,
+          body: {
+            roomId,
+            cursor
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function createRoom(name: string) {
+    if (!name) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.CREATE_ROOM,
+          body: {
+            name
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function renameRoom(roomId: string, name: string) {
+    if (!roomId || !name) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.RENAME_ROOM,
+          body: {
+            roomId,
+            name
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function deleteRoom(roomId: string) {
+    if (!roomId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.DELETE_ROOM,
+          body: {
             roomId
           }
         })
       );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function openDM(userId: string) {
+    if (!userId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.OPEN_DM,
+          body: {
+            userId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function sendDirectMessage(
+    msg: string,
+    userId: string,
+    attachments?: string[]
+  ) {
+    if (
+      !userId ||
+      (!msg && !attachments?.length) ||
+      ws.value?.readyState !== ws.value?.OPEN
+    )
+      return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.SEND_DIRECT_MESSAGE,
+          body: {
+            message: msg,
+            userId,
+            attachments
+          }
+        })
+      );
 
       messageInput.value = '';
     } catch (error) {
@@ -351,18 +775,128 @@ export default function useChat() {
     }
   }
 
-  function getOldMessages(
-    roomId: string | (string | null)[],
-    oldestMsgId: string
+  function getDirectRooms() {
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_DIRECT_ROOMS
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function focusRoom(roomId: string) {
+    // The server answers with the counts of every room
+    unread.value = {};
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.FOCUS_ROOM,
+          body: {
+            roomId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function editMessage(roomId: string, messageId: string, msg: string) {
+    if (!roomId || !messageId || !msg) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.EDIT_MESSAGE,
+          body: {
+            roomId,
+            messageId,
+            message: msg
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function getMessageRevisions(roomId: string, messageId: string) {
+    if (!roomId || !messageId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_MESSAGE_REVISIONS,
+          body: {
+            roomId,
+            messageId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function deleteMessage(roomId: string, messageId: string) {
+    if (!roomId || !messageId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.DELETE_MESSAGE,
+          body: {
+            roomId,
+            messageId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function react(
+    roomId: string,
+    messageId: string,
+    emoji: string,
+    add = true
   ) {
-    if (!roomId || !oldestMsgId) return;
+    if (!roomId || !messageId || !emoji) return;
 
     try {
       ws.value?.send(
         JSON.stringify({
-          type: RequestEvents.GET_OLD_MESSAGES,
+          type: add ? RequestEvents.ADD_REACTION : RequestEvents.REMOVE_REACTION,
           body: {
             roomId,
+            messageId,
+            emoji
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function getThread(roomId: string, parentId: string, oldestMsgId?: string) {
+    if (!roomId || !parentId) return;
+
+    // Opening another thread starts from its newest replies
+    if (!oldestMsgId) thread.value = undefined;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_THREAD,
+          body: {
+            roomId,
+            parentId,
             oldestMsgId
           }
         })
@@ -372,6 +906,195 @@ export default function useChat() {
     }
   }
 
+  function getMentions() {
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_MENTIONS
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // The server stops an indicator after a few quiet seconds, so keep calling
+  // this while the user types
+  function startTyping(roomId: string) {
+    if (!roomId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.TYPING_START,
+          body: {
+            roomId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function stopTyping(roomId: string) {
+    if (!roomId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.TYPING_STOP,
+          body: {
+            roomId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // Read positions only move forward, marking an older message is harmless
+  function markRead(roomId: string, messageId: string) {
+    if (!roomId || !messageId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.MARK_READ,
+          body: {
+            roomId,
+            messageId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function setPresence(presence: Presence) {
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.SET_PRESENCE,
+          body: {
+            presence
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // Words in double quotes are searched as a phrase. Timestamps are in ms
+  function searchMessages(
+    query: string,
+    filters: {
+      roomId?: string;
+      userId?: string;
+      since?: number;
+      until?: number;
+      offset?: number;
+    } = {}
+  ) {
+    if (!query) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.SEARCH_MESSAGES,
+          body: {
+            query,
+            ...filters
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // Opens the timeline around a message, e.g. a search result, or around the
+  // first message at or after a timestamp in ms
+  function getMessagesAround(
+    roomId: string,
+    anchor: { messageId: string } | { timestamp: number }
+  ) {
+    if (!roomId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_MESSAGES_AROUND,
+          body: {
+            roomId,
+            ...anchor
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  function getNewerMessages(roomId: string, newestMsgId: string) {
+    if (!roomId || !newestMsgId) return;
+
+    try {
+      ws.value?.send(
+        JSON.stringify({
+          type: RequestEvents.GET_NEWER_MESSAGES,
+          body: {
+            roomId,
+            newestMsgId
+          }
+        })
+      );
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // The HTTP API is served next to the chat socket
+  function apiUrl(path: string) {
+    return url.value.replace(/^ws/, 'http').replace(/\/ws\/chat$/, path);
+  }
+
+  // Uploads a file to send with a message, the quota of the user permitting
+  async function uploadAttachment(file: File) {
+    const form = new FormData();
+    form.append('file', file);
+
+    try {
+      const res = await fetch(apiUrl('/api/attachments'), {
+        method: 'POST',
+        headers: {
+          Authorization: `Bearer ${window.sessionStorage.getItem('token')}`
+        },
+        body: form
+      });
+      if (!res.ok) throw new Error(await res.text());
+      return (await res.json()).data as IAttachment;
+    } catch (error) {
+      console.error(error);
+    }
+  }
+
+  // Images load by themselves, so the token goes in the query. Given the
+  // size an image is shown at, the smallest thumbnail covering it is used
+  function attachmentUrl(attachment: IAttachment, size?: number) {
+    const token = window.sessionStorage.getItem('token') || '';
+    const thumbnail = size
+      ? (attachment.thumbnails || [])
+          .filter(t => t.size >= size)
+          .pop()
+      : undefined;
+    const path = thumbnail?.url || `/api/attachments/${attachment.id}`;
+    return apiUrl(`${path}?token=${encodeURIComponent(token)}`);
+  }
+
   return {
     connectChat,
     ws,
@@ -381,6 +1104,28 @@ export default function useChat() {
     joinChat,
     leftChat,
     sendMessage,
-    getOldMessages
+    getOldMessages,
+    createRoom,
+    renameRoom,
+    deleteRoom,
+    openDM,
+    sendDirectMessage,
+    getDirectRooms,
+    focusRoom,
+    editMessage,
+    getMessageRevisions,
+    deleteMessage,
+    react,
+    getThread,
+    getMentions,
+    startTyping,
+    stopTyping,
+    markRead,
+    setPresence,
+    searchMessages,
+    getMessagesAround,
+    getNewerMessages,
+    uploadAttachment,
+    attachmentUrl
   };
 }
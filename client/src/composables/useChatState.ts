@@ -1,11 +1,21 @@
 import { ref } from 'vue';
 import { useRoute } from 'vue-router';
 
+export enum Presence {
+  ONLINE,
+  AWAY,
+  DO_NOT_DISTURB,
+  OFFLINE
+}
+
 export interface IUser {
   id: string;
   username: string;
   avatar: string;
+  presence?: Presence;
+  lastSeen?: number; // when the user was last active, in ms
   doneLoading?: boolean;
+  nextCursor?: string; // where older messages continue
 }
 
 export function isUser(object: Record<any, any>): object is IUser {
@@ -15,13 +25,22 @@ export function isUser(object: Record<any, any>): object is IUser {
 export interface IRoom {
   id: string;
   name: string;
+  ownerId?: string;
+  members?: string[];
   doneLoading?: boolean;
+  nextCursor?: string; // where older messages continue
 }
 
 export function isRoom(object: Record<any, any>): object is IRoom {
   return 'name' in object;
 }
 
+export interface IDirectRoom {
+  room: IRoom;
+  user: IUser;
+  lastMessage?: IMessage;
+}
+
 export enum MessageType {
   NEW_MESSAGE,
   ME_CHANGED_USERNAME,
@@ -31,10 +50,58 @@ export enum MessageType {
   OTHER_JOINED
 }
 
+export interface IQuote {
+  id: string;
+  user: IUser;
+  excerpt: string;
+  timestamp: number;
+  deleted?: boolean;
+}
+
+export interface IMention {
+  userId: string;
+  username: string;
+  // offset and length in UTF-16 code units, as String.prototype.slice takes
+  offset: number;
+  length: number;
+}
+
+// A smaller copy of an image attachment
+export interface IThumbnail {
+  size: number; // bound of the longer side, in pixels
+  width: number;
+  height: number;
+  mimeType: string;
+  url: string;
+}
+
+// A file sent with a message, downloaded from attachmentUrl
+export interface IAttachment {
+  id: string;
+  userId: string;
+  roomId?: string;
+  name: string;
+  mimeType: string;
+  size: number; // in bytes
+  width?: number; // images only, in pixels
+  height?: number;
+  createdAt: number;
+  thumbnails?: IThumbnail[]; // largest first
+  placeholder?: string; // BlurHash to show while an image loads
+}
+
 export interface IMessage {
   id: string;
   message: string;
   timestamp: number;
+  editedAt?: number;
+  deletedAt?: number;
+  reactions?: Record<string, string[]>;
+  parentId?: string;
+  replyCount?: number;
+  replyTo?: IQuote;
+  mentions?: IMention[];
+  attachments?: IAttachment[];
   user: IUser;
   type: MessageType;
 }
@@ -48,8 +115,28 @@ const me = ref<IUser>({
 });
 const messageInput = ref('');
 const messages = ref<IMessage[]>([]);
+// The thread open next to the main timeline
+const thread = ref<{ parent: IMessage; messages: IMessage[] }>();
 const currentRoom = ref<IRoom | IUser>();
 const rooms = ref<IRoom[]>([]);
+const directRooms = ref<IDirectRoom[]>([]);
+const unread = ref<Record<string, number>>({});
+// Recent messages mentioning me, oldest first
+const mentions = ref<IMessage[]>([]);
+// Users typing, by room id
+const typing = ref<Record<string, IUser[]>>({});
+// Id of the last message each user read in the current room, by user id
+const reads = ref<Record<string, string>>({});
+// Results of the last search, pages appended as they come
+const search = ref<{
+  query: string;
+  messages: IMessage[];
+  hasMore: boolean;
+  nextOffset: number;
+}>({ query: '', messages: [], hasMore: false, nextOffset: 0 });
+// Set while the timeline shows a window around a message instead of the
+// latest messages
+const jump = ref<{ anchorId: string; hasNewer: boolean }>();
 const users = ref<IUser[]>([]);
 
 export default function useChatState() {
@@ -64,10 +151,18 @@ export default function useChatState() {
 
   return {
     rooms,
+    directRooms,
+    unread,
+    mentions,
+    typing,
+    reads,
+    search,
+    jump,
     users,
     me,
     messageInput,
     messages,
+    thread,
     currentRoom
   };
 }
@@ -0,0 +1,179 @@
+// Command loadtest measures the message throughput of a running chat server
+// across many busy rooms.
+//
+//	$ go run . -debug
+//	$ go run ./cmd/loadtest -rooms 15 -clients 20 -messages 200
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Request and response types as numbered by the server.
+const (
+	GET_ROOMS    = 0
+	JOIN_CHAT    = 2
+	SEND_MESSAGE = 4
+
+	TOPIC_ROOMS        = 2
+	ME_JOINED_CHAT     = 5
+	OTHER_MESSAGE_SEND = 10
+)
+
+type request struct {
+	Type int                    `json:"type"`
+	Body map[string]interface{} `json:"body,omitempty"`
+}
+
+type response struct {
+	Type int `json:"type"`
+	Body struct {
+		Data interface{} `json:"data"`
+	} `json:"body"`
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "chat server address")
+	origin := flag.String("origin", "", "Origin header to send (defaults to http://<addr>)")
+	rooms := flag.Int("rooms", 15, "number of busy rooms")
+	clients := flag.Int("clients", 10, "clients per room")
+	messages := flag.Int("messages", 100, "messages sent by every client")
+	idle := flag.Duration("idle", 5*time.Second, "stop waiting once nothing arrived for this long")
+	flag.Parse()
+
+	if *origin == "" {
+		*origin = "http://" + *addr
+	}
+	url := fmt.Sprintf("ws://%s/ws/chat", *addr)
+	header := http.Header{"Origin": []string{*origin}}
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return conn
+	}
+
+	// Pick the rooms
+	roomIDs := topicRooms(dial())
+	if len(roomIDs) < *rooms {
+		log.Printf("server has %d rooms, using all of them\n", len(roomIDs))
+		*rooms = len(roomIDs)
+	}
+	roomIDs = roomIDs[:*rooms]
+
+	// Connect and join every client
+	var conns []*websocket.Conn
+	var connRooms []string
+	for _, roomID := range roomIDs {
+		for i := 0; i < *clients; i++ {
+			conn := dial()
+			write(conn, request{Type: JOIN_CHAT, Body: map[string]interface{}{"roomId": roomID}})
+			until(conn, ME_JOINED_CHAT)
+			conns = append(conns, conn)
+			connRooms = append(connRooms, roomID)
+		}
+	}
+
+	var (
+		delivered int64
+		last      int64
+		wg        sync.WaitGroup
+	)
+	expected := int64(len(conns) * (*clients - 1) * *messages)
+	start := time.Now()
+	atomic.StoreInt64(&last, start.UnixNano())
+
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			for {
+				conn.SetReadDeadline(time.Now().Add(*idle))
+				var res response
+				if err := conn.ReadJSON(&res); err != nil {
+					return // idle or closed
+				}
+				if res.Type == OTHER_MESSAGE_SEND {
+					if atomic.AddInt64(&delivered, 1) == expected {
+						atomic.StoreInt64(&last, time.Now().UnixNano())
+						closeAll(conns)
+						return
+					}
+					atomic.StoreInt64(&last, time.Now().UnixNano())
+				}
+			}
+		}(conn)
+
+		go func(conn *websocket.Conn, roomID string) {
+			for j := 0; j < *messages; j++ {
+				if err := conn.WriteJSON(request{Type: SEND_MESSAGE, Body: map[string]interface{}{
+					"roomId":  roomID,
+					"message": fmt.Sprintf("load %d", j),
+				}}); err != nil {
+					return // closed once everything was delivered
+				}
+			}
+		}(conn, connRooms[i])
+	}
+	wg.Wait()
+
+	elapsed := time.Duration(atomic.LoadInt64(&last) - start.UnixNano())
+	sent := len(conns) * *messages
+	fmt.Printf("rooms:      %d\n", *rooms)
+	fmt.Printf("clients:    %d\n", len(conns))
+	fmt.Printf("sent:       %d (%.0f msg/s)\n", sent, float64(sent)/elapsed.Seconds())
+	fmt.Printf("delivered:  %d of %d (%.0f msg/s)\n", delivered, expected, float64(delivered)/elapsed.Seconds())
+	fmt.Printf("elapsed:    %s\n", elapsed)
+}
+
+func topicRooms(conn *websocket.Conn) []string {
+	defer conn.Close()
+
+	write(conn, request{Type: GET_ROOMS})
+	res := until(conn, TOPIC_ROOMS)
+
+	var ids []string
+	rooms, _ := res.Body.Data.([]interface{})
+	for _, room := range rooms {
+		if m, ok := room.(map[string]interface{}); ok {
+			if id, ok := m["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+func until(conn *websocket.Conn, typ int) response {
+	for {
+		var res response
+		if err := conn.ReadJSON(&res); err != nil {
+			log.Fatal(err)
+		}
+		if res.Type == typ {
+			return res
+		}
+	}
+}
+
+func write(conn *websocket.Conn, req request) {
+	if err := conn.WriteJSON(req); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func closeAll(conns []*websocket.Conn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
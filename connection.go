@@ -1,37 +1,208 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofiber/websocket/v2"
 )
 
+var (
+	ErrConnectionClosed = errors.New("connection is closed")
+	ErrSlowConsumer     = errors.New("connection is too slow, disconnecting")
+)
+
+// writeWait is how long a single frame may take to reach a client.
+const writeWait = 10 * time.Second
+
+// SlowConsumerPolicy decides what happens when a connection's outbound queue
+// is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued frame to make room for the new one.
+	DropOldest SlowConsumerPolicy = iota
+	// Disconnect closes the connection.
+	Disconnect
+)
+
+func (p SlowConsumerPolicy) String() string {
+	return []string{
+		"drop-oldest",
+		"disconnect",
+	}[p]
+}
+
+// QueueStats are shared by every connection of a hub.
+type QueueStats struct {
+	Dropped int64
+	Evicted int64
+}
+
+// Connection wraps a websocket connection with a bounded outbound queue that
+// is drained by its own writer goroutine, so a slow client only holds up
+// itself.
+type Connection struct {
+	*websocket.Conn
+	sync.Mutex
+	// ClientID is read from the locals once, the websocket connection is
+	// reused for another client after its handler returns
+	ClientID string
+	queue    chan []byte
+	policy   SlowConsumerPolicy
+	stats    *QueueStats
+	closed   bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+func NewConnection(conn *websocket.Conn, size int, policy SlowConsumerPolicy, stats *QueueStats) *Connection {
+	c := &Connection{
+		Conn:   conn,
+		queue:  make(chan []byte, size),
+		policy: policy,
+		stats:  stats,
+		done:   make(chan struct{}),
+	}
+	c.ClientID, _ = conn.Locals("ClientID").(string)
+	go c.write()
+	return c
+}
+
+// WriteJSON queues v to be sent. v is encoded right away, so it may be
+// modified once WriteJSON returns.
+func (c *Connection) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return ErrConnectionClosed
+	}
+
+	select {
+	case c.queue <- data:
+		return nil
+	default:
+	}
+
+	switch c.policy {
+	case DropOldest:
+		// Only writers holding the lock push, so there is room after one pop
+		select {
+		case <-c.queue:
+			atomic.AddInt64(&c.stats.Dropped, 1)
+		default:
+		}
+		c.queue <- data
+		return nil
+
+	default:
+		atomic.AddInt64(&c.stats.Evicted, 1)
+		c.close()
+		c.closeConn() // unblocks the reader and a stalled writer
+		return ErrSlowConsumer
+	}
+}
+
+// Depth returns the number of frames waiting to be sent.
+func (c *Connection) Depth() int {
+	return len(c.queue)
+}
+
+// Kick closes the connection right away with a normal closure, which tells the
+// client not to reconnect.
+func (c *Connection) Kick(reason string) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.closeConn()
+}
+
+// Close stops accepting frames, waits for the queued ones to be written and
+// closes the websocket connection.
+func (c *Connection) Close() error {
+	c.Lock()
+	c.close()
+	c.Unlock()
+
+	<-c.done
+	return c.closeConn()
+}
+
+// close must be called with the lock held.
+func (c *Connection) close() {
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+func (c *Connection) closeConn() error {
+	var err error
+	c.once.Do(func() {
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+func (c *Connection) write() {
+	defer close(c.done)
+
+	var err error
+	for data := range c.queue {
+		if err != nil {
+			continue // drain until the queue is closed
+		}
+
+		if err = c.Conn.SetWriteDeadline(time.Now().Add(writeWait)); err == nil {
+			err = c.Conn.WriteMessage(websocket.TextMessage, data)
+		}
+		if err != nil {
+			c.Lock()
+			c.close()
+			c.Unlock()
+			c.closeConn() // the reader may otherwise wait on a stalled client forever
+		}
+	}
+}
+
 type ConnectionStore interface {
-	Store(clientID string, conn *websocket.Conn)
-	Load(clientID string) (conn *websocket.Conn, ok bool)
+	Store(clientID string, conn *Connection)
+	Load(clientID string) (conn *Connection, ok bool)
 	Delete(clientID string)
+	// CompareAndDelete deletes the connection of clientID only if it is conn
+	// and reports whether it did, so only one caller goes on to clean up.
+	CompareAndDelete(clientID string, conn *Connection) bool
+	Range(f func(clientID string, conn *Connection))
 }
 
 type InMemoryConnectionStore struct {
 	sync.Mutex
-	connections map[string]*websocket.Conn
+	connections map[string]*Connection
 }
 
 var _ ConnectionStore = (*InMemoryConnectionStore)(nil)
 
 func NewInMemoryConnectionStore() *InMemoryConnectionStore {
 	return &InMemoryConnectionStore{
-		connections: map[string]*websocket.Conn{},
+		connections: map[string]*Connection{},
 	}
 }
 
-func (s *InMemoryConnectionStore) Store(clientID string, conn *websocket.Conn) {
+func (s *InMemoryConnectionStore) Store(clientID string, conn *Connection) {
 	s.Lock()
 	s.connections[clientID] = conn
 	s.Unlock()
 }
 
-func (s *InMemoryConnectionStore) Load(clientID string) (conn *websocket.Conn, ok bool) {
+func (s *InMemoryConnectionStore) Load(clientID string) (conn *Connection, ok bool) {
 	s.Lock()
 	conn, ok = s.connections[clientID]
 	s.Unlock()
@@ -43,3 +214,27 @@ func (s *InMemoryConnectionStore) Delete(clientID string) {
 	delete(s.connections, clientID)
 	s.Unlock()
 }
+
+func (s *InMemoryConnectionStore) CompareAndDelete(clientID string, conn *Connection) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if c, ok := s.connections[clientID]; !ok || c != conn {
+		return false
+	}
+	delete(s.connections, clientID)
+	return true
+}
+
+func (s *InMemoryConnectionStore) Range(f func(clientID string, conn *Connection)) {
+	s.Lock()
+	connections := make(map[string]*Connection, len(s.connections))
+	for clientID, conn := range s.connections {
+		connections[clientID] = conn
+	}
+	s.Unlock()
+
+	for clientID, conn := range connections {
+		f(clientID, conn)
+	}
+}
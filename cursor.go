@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrCursorExpired tells a client its cursor points at a message no longer
+// kept, so it has seen all history there is.
+var ErrCursorExpired = fiber.NewError(fiber.StatusGone, "cursor expired")
+
+// Cursor points at a message of the main timeline to page back from. The
+// timestamp finds it without a scan, the id tells apart messages with the
+// same timestamp. Timestamps are in ms but only change once a second, so a
+// busy room has many of those.
+type Cursor struct {
+	Timestamp int64
+	MsgID     string
+}
+
+func CursorOf(message Message) Cursor {
+	return Cursor{
+		Timestamp: message.Timestamp,
+		MsgID:     message.ID,
+	}
+}
+
+// String encodes c for clients, which must treat it as opaque.
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Timestamp, 10) + ":" + c.MsgID))
+}
+
+func ParseCursor(s string) (c Cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fiber.ErrBadRequest
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return c, fiber.ErrBadRequest
+	}
+	if c.Timestamp, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return c, fiber.ErrBadRequest
+	}
+	c.MsgID = parts[1]
+	return c, nil
+}
+
+// history pages messages, up to n+1 of the main timeline oldest first, to
+// the n newest with their authors. The cursor of the next page is empty when
+// there is none.
+func (h *Hub) history(messages []Message, n int) (page []Message, nextCursor string) {
+	if len(messages) > n {
+		messages = messages[len(messages)-n:]
+		nextCursor = CursorOf(messages[0]).String()
+	}
+	for _, message := range messages {
+		message.User = h.author(message)
+		page = append(page, message)
+	}
+	return page, nextCursor
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// messageStores returns an empty store of each driver.
+func messageStores(t *testing.T) map[StorageDriver]MessageStore {
+	t.Helper()
+	sqlite, err := NewSQLiteMessageStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.db.Close() })
+	bolt, err := NewBoltStorage(filepath.Join(t.TempDir(), "chat.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[StorageDriver]MessageStore{
+		MemoryDriver: NewInMemoryMessageStore(),
+		SQLiteDriver: sqlite,
+		BoltDriver:   bolt.MessageStore(),
+	}
+}
+
+// TestGetBeforeSameTimestamp pages back through a room where most messages
+// were sent within one second, so pages start and end among messages with
+// the same timestamp. Every message has to come exactly once, in order.
+func TestGetBeforeSameTimestamp(t *testing.T) {
+	const n = 10 // page size
+	for driver, store := range messageStores(t) {
+		t.Run(string(driver), func(t *testing.T) {
+			var sent []string
+			for i := 0; i < 95; i++ {
+				timestamp := int64(2000)
+				switch {
+				case i < 3:
+					timestamp = 1000
+				case i >= 90:
+					timestamp = 3000
+				}
+				message := Message{ID: fmt.Sprintf("msg-%02d", i), UserID: "user", RoomID: "room", Message: "hi", Timestamp: timestamp}
+				store.Append("room", message)
+				sent = append(sent, message.ID)
+			}
+
+			// Newest page first, one more message tells whether there are older
+			var received []string
+			messages := store.GetLastN("room", n+1)
+			for {
+				more := len(messages) > n
+				if more {
+					messages = messages[len(messages)-n:]
+				}
+				var ids []string
+				for _, message := range messages {
+					ids = append(ids, message.ID)
+				}
+				received = append(ids, received...)
+				if !more {
+					break
+				}
+				cursor := CursorOf(messages[0])
+				var ok bool
+				if messages, ok = store.GetBefore("room", n+1, cursor); !ok {
+					t.Fatalf("cursor at %s expired", cursor.MsgID)
+				}
+			}
+
+			if fmt.Sprint(received) != fmt.Sprint(sent) {
+				t.Fatalf("paged %v\nwant %v", received, sent)
+			}
+		})
+	}
+}
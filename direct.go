@@ -0,0 +1,253 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// directRoomNamespace scopes the ids of direct rooms.
+var directRoomNamespace = uuid.MustParse("4f0b6a0e-8f5c-4c8e-9d43-2b8f1d1c7a53")
+
+// directRoomID returns the same room id for a pair of users, whichever of
+// them opens the conversation.
+func directRoomID(userID string, peerID string) string {
+	ids := []string{userID, peerID}
+	sort.Strings(ids)
+	return uuid.NewSHA1(directRoomNamespace, []byte(strings.Join(ids, "|"))).String()
+}
+
+// direct_room loads the direct room of a pair of users, creating it on first
+// use. It reports an error to conn if the peer is unknown.
+func (h *Hub) direct_room(conn *Connection, userID string, peerID string) (room Room, peer User, ok bool) {
+	if peerID == "" || peerID == userID {
+		h.error(conn, fiber.ErrBadRequest)
+		return room, peer, false
+	}
+	if peer, ok = h.user.Profile(peerID); !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return room, peer, false
+	}
+
+	roomID := directRoomID(userID, peerID)
+	if room, ok = h.room.Room(roomID); ok {
+		return room, peer, true
+	}
+
+	room = Room{
+		ID:      roomID,
+		Type:    DirectRoom,
+		Members: []string{userID, peerID},
+	}
+	h.room.Add(room) // may lose a race against the peer, same room either way
+	return room, peer, true
+}
+
+func (h *Hub) open_dm(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read userId from request body
+	peerID, ok := req.Body["userId"].(string)
+	if !ok {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load or create the conversation
+	room, peer, ok := h.direct_room(conn, req.ClientID, peerID)
+	if !ok {
+		return
+	}
+
+	// Get last n messages of the conversation, one more tells whether there
+	// are older
+	n := h.Options.MaxReturnedMessage
+	messages, nextCursor := h.history(h.message.GetLastN(room.ID, n+1), n)
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]interface{}{
+				"room":       room,
+				"user":       &peer,
+				"messages":   &messages,
+				"nextCursor": nextCursor,
+			},
+		},
+		Type: DM_OPENED,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+func (h *Hub) send_direct_message(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read userId and message from request body
+	var peerID, message string
+	{
+		tmpID, okID := req.Body["userId"].(string)
+		tmpMsg, okMsg := req.Body["message"].(string)
+		if !okID || !okMsg {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+		peerID, message = tmpID, tmpMsg
+	}
+	if err := validateMessage(message, attachmentCount(req)); err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	// Load user
+	user, ok := h.user.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Load or create the conversation
+	room, _, ok := h.direct_room(conn, req.ClientID, peerID)
+	if !ok {
+		return
+	}
+
+	// Files uploaded beforehand go with the message
+	attachments, err := h.attachments(req, room.ID)
+	if err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	// Save new message along with its author
+	newMessage := Message{
+		ID:          req.ID,
+		UserID:      req.ClientID,
+		User:        &user,
+		RoomID:      room.ID,
+		Message:     message,
+		Timestamp:   time.Now().Unix() * 1000, // in ms
+		Attachments: attachments,
+	}
+	h.message.Append(room.ID, newMessage)
+
+	// Remove old messages
+	h.trim(room.ID, h.Options.MaxSavedMessage)
+
+	// Inform user itself here
+	res := Response{
+		Body: map[string]interface{}{
+			"data": &newMessage,
+		},
+		Type: ME_DIRECT_MESSAGE_SEND,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_DIRECT_MESSAGE_SEND,
+		Room:    &room,
+		Message: &newMessage,
+	})
+
+	// Inform the peer wherever it is
+	h.deliver_direct(peerID, &newMessage)
+}
+
+func (h *Hub) get_direct_rooms(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Describe each conversation by its peer and last message
+	conversations := []map[string]interface{}{}
+	for _, room := range h.room.DirectRooms(req.ClientID) {
+		var peer User
+		for _, id := range room.Members {
+			if id == req.ClientID {
+				continue
+			}
+			if p, ok := h.user.Profile(id); ok {
+				peer = p
+			} else {
+				peer = User{ID: id, Username: "<removed>"}
+			}
+		}
+
+		var last *Message
+		if messages := h.message.GetLastN(room.ID, 1); len(messages) > 0 {
+			last = &messages[0]
+			last.User = h.author(*last)
+		}
+
+		conversations = append(conversations, map[string]interface{}{
+			"room":        room,
+			"user":        peer,
+			"lastMessage": last,
+		})
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": &conversations,
+		},
+		Type: DIRECT_ROOMS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// deliver_direct sends a direct message to userID if it is connected here.
+func (h *Hub) deliver_direct(userID string, message *Message) {
+	c, ok := h.connection.Load(userID)
+	if !ok {
+		return // offline, the message waits in the conversation
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": message,
+		},
+		Type: OTHER_DIRECT_MESSAGE_SEND,
+	}
+
+	if err := c.WriteJSON(res); err != nil {
+		if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+			h.unregister(c)
+		}
+	}
+}
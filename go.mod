@@ -3,7 +3,11 @@ module github.com/ysfada/chat-app
 go 1.16
 
 require (
+	github.com/fasthttp/websocket v0.0.0-20200320073529-1554a54587ab
 	github.com/gofiber/fiber/v2 v2.14.0
 	github.com/gofiber/websocket/v2 v2.0.7
-	github.com/google/uuid v1.2.0
+	github.com/google/uuid v1.3.0
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	modernc.org/sqlite v1.14.2
 )
@@ -1,62 +1,249 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
 )
 
+type StorageDriver string
+
+const (
+	MemoryDriver StorageDriver = "memory"
+	SQLiteDriver StorageDriver = "sqlite"
+	BoltDriver   StorageDriver = "bolt"
+)
+
+type StorageOptions struct {
+	Driver        StorageDriver
+	Path          string // database file, unused by MemoryDriver
+	AttachmentDir string // uploaded files, whatever the driver
+}
+
 type HubOptions struct {
 	MaxSavedMessage    int
 	MaxReturnedMessage int
+	QueueSize          int // outbound frames buffered per connection
+	SlowConsumerPolicy SlowConsumerPolicy
+	Storage            StorageOptions
+	Secret             []byte        // signs tokens, must be shared by prefork processes
+	TokenTTL           time.Duration // how long a resume token is accepted
+	ResumeGrace        time.Duration // how long a disconnected session can be resumed
+	EditWindow         time.Duration // how long a message can be edited, zero for no limit
+	Moderators         []string      // user ids allowed to moderate every room
+	TypingTimeout      time.Duration // how long typing lasts without a new TYPING_START
+	TypingThrottle     time.Duration // least time between two relayed starts of a user in a room
+	AwayTimeout        time.Duration // how long an online user is idle before it is set away, zero to never
+	MaxAttachmentSize  int64         // largest file that can be uploaded, in bytes
+	AttachmentQuota    int64         // bytes of files a user can upload in total
+}
+
+type HubMetrics struct {
+	Connections int   `json:"connections"`
+	Queued      int   `json:"queued"`   // frames waiting in all queues
+	MaxDepth    int   `json:"maxDepth"` // frames waiting in the deepest queue
+	Dropped     int64 `json:"dropped"`  // frames dropped by DropOldest
+	Evicted     int64 `json:"evicted"`  // connections closed by Disconnect
 }
 
 type Hub struct {
-	Register       chan *websocket.Conn
-	Unregister     chan *websocket.Conn
-	GetRooms       chan *websocket.Conn
+	Register       chan *Connection
+	Unregister     chan *Connection
+	GetRooms       chan *Connection
 	ChangeUsername chan *Request
 	JoinChat       chan *Request
 	LeaveChat      chan *Request
 	SendMessage    chan *Request
 	OldMessages    chan *Request
+	CreateRoom     chan *Request
+	RenameRoom     chan *Request
+	DeleteRoom     chan *Request
+	OpenDM         chan *Request
+	DirectMessage  chan *Request
+	DirectRooms    chan *Request
+	FocusRoom      chan *Request
+	EditMessage    chan *Request
+	Revisions      chan *Request
+	DeleteMessage  chan *Request
+	React          chan *Request
+	Thread         chan *Request
+	Mentions       chan *Request
+	Typing         chan *Request
+	MarkRead       chan *Request
+	Presence       chan *Request
+	Search         chan *Request
+	Around         chan *Request
+	NewerMessages  chan *Request
 	Options        *HubOptions
+	Broker         Broker
+	node           string
+	stats          QueueStats
+	actors         map[string]*RoomActor
+	actorsLock     sync.Mutex
 	connection     ConnectionStore
+	session        SessionStore
+	unread         UnreadStore
+	typing         TypingStore
+	presence       PresenceStore
+	attachment     AttachmentStore
+	thumbnailing   chan struct{} // a slot per image being thumbnailed
 	user           UserStore
 	room           RoomStore
 	message        MessageStore
+	closers        []io.Closer
 }
 
-func (h *Hub) Defaults() {
+func (h *Hub) Defaults(storage ...StorageOptions) error {
 	h.Options = &HubOptions{
 		MaxSavedMessage:    500,
 		MaxReturnedMessage: 20,
+		QueueSize:          256,
+		SlowConsumerPolicy: DropOldest,
+		Storage: StorageOptions{
+			Driver:        MemoryDriver,
+			AttachmentDir: "uploads",
+		},
+		Secret:         make([]byte, 32),
+		TokenTTL:       24 * time.Hour,
+		ResumeGrace:    2 * time.Minute,
+		EditWindow:     15 * time.Minute,
+		TypingTimeout:  6 * time.Second,
+		TypingThrottle: 3 * time.Second,
+		AwayTimeout:    5 * time.Minute,
+
+		MaxAttachmentSize: 10 << 20,
+		AttachmentQuota:   100 << 20,
 	}
+	if len(storage) > 0 {
+		h.Options.Storage = storage[0]
+		if h.Options.Storage.AttachmentDir == "" {
+			h.Options.Storage.AttachmentDir = "uploads"
+		}
+	}
+	if _, err := rand.Read(h.Options.Secret); err != nil {
+		return err
+	}
+
+	h.Broker = NewInProcessBroker()
 	h.connection = NewInMemoryConnectionStore()
-	h.user = NewInMemoryUserStore()
-	h.room = NewInMemoryRoomStore()
-	h.message = NewInMemoryMessageStore()
+	h.session = NewInMemorySessionStore()
+	h.unread = NewInMemoryUnreadStore()
+	h.typing = NewInMemoryTypingStore()
+	h.presence = NewInMemoryPresenceStore()
+	h.attachment = NewDiskAttachmentStore(h.Options.Storage.AttachmentDir)
+
+	switch h.Options.Storage.Driver {
+	case MemoryDriver:
+		h.user = NewInMemoryUserStore()
+		h.room = NewInMemoryRoomStore()
+		h.message = NewInMemoryMessageStore()
+
+	case SQLiteDriver:
+		message, err := NewSQLiteMessageStore(h.Options.Storage.Path)
+		if err != nil {
+			return err
+		}
+		h.closers = append(h.closers, message)
+		h.user = NewInMemoryUserStore()
+		h.room = NewInMemoryRoomStore()
+		h.message = message
+
+	case BoltDriver:
+		db, err := NewBoltStorage(h.Options.Storage.Path)
+		if err != nil {
+			return err
+		}
+		h.closers = append(h.closers, db)
+		h.user = db.UserStore()
+		h.room = db.RoomStore()
+		h.message = db.MessageStore()
+
+	default:
+		return fmt.Errorf("unknown storage driver %q", h.Options.Storage.Driver)
+	}
+	return nil
+}
+
+// Close releases the broker and the storage opened by Defaults.
+func (h *Hub) Close() error {
+	err := h.Broker.Close()
+	for _, c := range h.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		Register:       make(chan *websocket.Conn),
-		Unregister:     make(chan *websocket.Conn),
-		GetRooms:       make(chan *websocket.Conn),
+		Register:       make(chan *Connection),
+		Unregister:     make(chan *Connection),
+		GetRooms:       make(chan *Connection),
 		ChangeUsername: make(chan *Request),
 		JoinChat:       make(chan *Request),
 		LeaveChat:      make(chan *Request),
 		SendMessage:    make(chan *Request),
 		OldMessages:    make(chan *Request),
+		CreateRoom:     make(chan *Request),
+		RenameRoom:     make(chan *Request),
+		DeleteRoom:     make(chan *Request),
+		OpenDM:         make(chan *Request),
+		DirectMessage:  make(chan *Request),
+		DirectRooms:    make(chan *Request),
+		FocusRoom:      make(chan *Request),
+		EditMessage:    make(chan *Request),
+		Revisions:      make(chan *Request),
+		DeleteMessage:  make(chan *Request),
+		React:          make(chan *Request),
+		Thread:         make(chan *Request),
+		Mentions:       make(chan *Request),
+		Typing:         make(chan *Request),
+		MarkRead:       make(chan *Request),
+		Presence:       make(chan *Request),
+		Search:         make(chan *Request),
+		Around:         make(chan *Request),
+		NewerMessages:  make(chan *Request),
+		node:           uuid.New().String(),
+		actors:         map[string]*RoomActor{},
+		thumbnailing:   make(chan struct{}, MaxThumbnailJobs),
 	}
 }
 
 func (h *Hub) Upgrade(c *fiber.Ctx) error {
 	// IsWebSocketUpgrade returns true if the client requested upgrade to the WebSocket protocol.
 	if websocket.IsWebSocketUpgrade(c) {
+		token := c.Query("token")
+
+		// Authenticated clients connect as their account
+		if userID, err := NewTokenSigner(h.Options.Secret).Verify(AuthToken, token); err == nil {
+			if _, ok := h.user.LoadAccount(userID); !ok {
+				return fiber.ErrUnauthorized
+			}
+			c.Locals("ClientID", userID)
+			return c.Next()
+		} else if err == ErrExpiredToken {
+			return fiber.ErrUnauthorized
+		}
+
+		// Reconnecting clients keep their identity
+		if clientID, ok := h.resume(token); ok {
+			c.Locals("ClientID", clientID)
+			return c.Next()
+		}
+
 		uuid, err := uuid.NewRandom()
 		if err != nil {
 			return fiber.ErrInternalServerError
@@ -67,7 +254,47 @@ func (h *Hub) Upgrade(c *fiber.Ctx) error {
 	return fiber.ErrUpgradeRequired
 }
 
-func (h *Hub) Handler(conn *websocket.Conn) {
+// resume returns the user id of a valid resume token whose user is still
+// connected or left a session behind.
+func (h *Hub) resume(token string) (userID string, ok bool) {
+	if token == "" {
+		return "", false
+	}
+
+	userID, err := NewTokenSigner(h.Options.Secret).Verify(ResumeToken, token)
+	if err != nil {
+		return "", false
+	}
+
+	if _, ok := h.session.Load(userID); ok {
+		return userID, true
+	}
+	if _, ok := h.connection.Load(userID); ok {
+		return userID, true
+	}
+	return "", false
+}
+
+// Metrics reports the outbound queues of the connections.
+func (h *Hub) Metrics(c *fiber.Ctx) error {
+	metrics := HubMetrics{
+		Dropped: atomic.LoadInt64(&h.stats.Dropped),
+		Evicted: atomic.LoadInt64(&h.stats.Evicted),
+	}
+	h.connection.Range(func(clientID string, conn *Connection) {
+		depth := conn.Depth()
+		metrics.Connections++
+		metrics.Queued += depth
+		if depth > metrics.MaxDepth {
+			metrics.MaxDepth = depth
+		}
+	})
+	return c.JSON(metrics)
+}
+
+func (h *Hub) Handler(c *websocket.Conn) {
+	conn := NewConnection(c, h.Options.QueueSize, h.Options.SlowConsumerPolicy, &h.stats)
+
 	// When the function returns, unregister the client and close the connection
 	defer func() {
 		h.Unregister <- conn
@@ -84,6 +311,12 @@ func (h *Hub) Handler(conn *websocket.Conn) {
 		// Read incomming message
 		var request Request
 		if err := conn.ReadJSON(&request); err != nil {
+			// Anything but a malformed request means the connection is gone
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+				return // Calls the deferred function, i.e. closes the connection
+			}
 			if e := h.error(conn, fiber.ErrBadRequest); e != nil {
 				return // Calls the deferred function, i.e. closes the connection on error
 			}
@@ -120,6 +353,9 @@ func (h *Hub) Handler(conn *websocket.Conn) {
 			}
 		}
 
+		// Any request shows user is not idle
+		h.presence.Touch(request.ClientID, time.Now())
+
 		// Handle incomming request base of its type
 		switch request.Type {
 
@@ -141,6 +377,63 @@ func (h *Hub) Handler(conn *websocket.Conn) {
 		case GET_OLD_MESSAGES:
 			h.OldMessages <- &request
 
+		case CREATE_ROOM:
+			h.CreateRoom <- &request
+
+		case RENAME_ROOM:
+			h.RenameRoom <- &request
+
+		case DELETE_ROOM:
+			h.DeleteRoom <- &request
+
+		case OPEN_DM:
+			h.OpenDM <- &request
+
+		case SEND_DIRECT_MESSAGE:
+			h.DirectMessage <- &request
+
+		case GET_DIRECT_ROOMS:
+			h.DirectRooms <- &request
+
+		case FOCUS_ROOM:
+			h.FocusRoom <- &request
+
+		case EDIT_MESSAGE:
+			h.EditMessage <- &request
+
+		case GET_MESSAGE_REVISIONS:
+			h.Revisions <- &request
+
+		case DELETE_MESSAGE:
+			h.DeleteMessage <- &request
+
+		case ADD_REACTION, REMOVE_REACTION:
+			h.React <- &request
+
+		case GET_THREAD:
+			h.Thread <- &request
+
+		case GET_MENTIONS:
+			h.Mentions <- &request
+
+		case TYPING_START, TYPING_STOP:
+			h.Typing <- &request
+
+		case MARK_READ:
+			h.MarkRead <- &request
+
+		case SET_PRESENCE:
+			h.Presence <- &request
+
+		case SEARCH_MESSAGES:
+			h.Search <- &request
+
+		case GET_MESSAGES_AROUND:
+			h.Around <- &request
+
+		case GET_NEWER_MESSAGES:
+			h.NewerMessages <- &request
+
 		default:
 			if e := h.error(conn, fiber.ErrBadRequest); e != nil {
 				return // Calls the deferred function, i.e. closes the connection on error
@@ -150,6 +443,14 @@ func (h *Hub) Handler(conn *websocket.Conn) {
 }
 
 func (h *Hub) Run() {
+	events := h.Broker.Subscribe()
+
+	typing := time.NewTicker(typingSweepInterval)
+	defer typing.Stop()
+
+	presence := time.NewTicker(presenceSweepInterval)
+	defer presence.Stop()
+
 	for {
 		select {
 		case conn := <-h.Register:
@@ -165,26 +466,166 @@ func (h *Hub) Run() {
 			h.change_username(req)
 
 		case req := <-h.JoinChat:
-			h.join_chat(req)
+			h.route(req)
 
 		case req := <-h.LeaveChat:
-			h.leave_chat(req)
+			h.route(req)
 
 		case req := <-h.SendMessage:
-			h.send_message(req)
+			h.route(req)
 
 		case req := <-h.OldMessages:
-			h.old_messages(req)
+			h.route(req)
+
+		case req := <-h.CreateRoom:
+			h.create_room(req)
+
+		case req := <-h.RenameRoom:
+			h.rename_room(req)
+
+		case req := <-h.DeleteRoom:
+			h.delete_room(req)
+
+		case req := <-h.OpenDM:
+			h.open_dm(req)
+
+		case req := <-h.DirectMessage:
+			h.send_direct_message(req)
+
+		case req := <-h.DirectRooms:
+			h.get_direct_rooms(req)
+
+		case req := <-h.FocusRoom:
+			h.focus_room(req)
+
+		case req := <-h.EditMessage:
+			h.route(req)
+
+		case req := <-h.Revisions:
+			h.route(req)
+
+		case req := <-h.DeleteMessage:
+			h.route(req)
+
+		case req := <-h.React:
+			h.route(req)
+
+		case req := <-h.Thread:
+			h.route(req)
+
+		case req := <-h.Mentions:
+			h.get_mentions(req)
+
+		case req := <-h.Typing:
+			h.route(req)
+
+		case req := <-h.MarkRead:
+			h.route(req)
+
+		case req := <-h.Presence:
+			h.set_presence(req)
+
+		case req := <-h.Search:
+			h.search_messages(req)
+
+		case req := <-h.Around:
+			h.route(req)
+
+		case req := <-h.NewerMessages:
+			h.route(req)
+
+		case now := <-typing.C:
+			h.expire_typing(now)
+
+		case now := <-presence.C:
+			h.sweep_presence(now)
+
+		case event, ok := <-events:
+			if !ok {
+				events = nil // broker is closed
+				continue
+			}
+
+			// Events of a room are handled by its actor
+			if actor, ok := h.actor(event.RoomID); ok {
+				actor.Event(event)
+			} else {
+				h.remote_event(event)
+			}
+		}
+	}
+}
+
+// route hands a request over to the actor of the room it belongs to.
+func (h *Hub) route(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId from request body
+	var roomID string
+	{
+		if tmp, ok := req.Body["roomId"]; ok {
+			if s, ok := tmp.(string); ok {
+				roomID = s
+			} else {
+				h.error(conn, fiber.ErrBadRequest)
+				return
+			}
+		} else {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+	}
+
+	// Direct rooms are only used by their members and are not joined, see
+	// open_dm
+	if room, ok := h.room.Room(roomID); ok && room.Type == DirectRoom {
+		switch {
+		case !contains(room.Members, req.ClientID),
+			req.Type == JOIN_CHAT,
+			req.Type == LEFT_CHAT,
+			req.Type == SEND_MESSAGE:
+			h.error(conn, fiber.ErrForbidden)
+			return
 		}
 	}
+
+	actor, ok := h.actor(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	actor.Request(req)
+}
+
+// actor returns the actor of an existing room, starting it on first use.
+func (h *Hub) actor(roomID string) (actor *RoomActor, ok bool) {
+	h.actorsLock.Lock()
+	defer h.actorsLock.Unlock()
+
+	if actor, ok = h.actors[roomID]; ok {
+		return actor, true
+	}
+	if _, ok = h.room.Room(roomID); !ok {
+		return nil, false
+	}
+
+	actor = NewRoomActor(h, roomID)
+	h.actors[roomID] = actor
+	go actor.Run()
+	return actor, true
 }
 
-func (h *Hub) register(conn *websocket.Conn) {
+func (h *Hub) register(conn *Connection) {
 	// Read ClientID
 	var clientID string
 	{
-		tmp := conn.Locals("ClientID")
-		if str, ok := tmp.(string); ok && len(str) > 0 {
+		if str := conn.ClientID; len(str) > 0 {
 			clientID = str
 		} else {
 			h.unregister(conn)
@@ -199,6 +640,39 @@ func (h *Hub) register(conn *websocket.Conn) {
 		Avatar:   "https://picsum.photos/56/56", // TODO: create a default avatar to use
 		// Avatar:   "https://thispersondoesnotexist.com/image", // TODO: create a default avatar to use
 	}
+
+	// Restore user and rooms of a resumed session
+	var roomIDs []string
+	if session, ok := h.session.Load(clientID); ok {
+		user = session.User
+		roomIDs = session.RoomIDs
+		h.session.Delete(clientID)
+
+		// Inform other processes
+		h.publish(Event{
+			Type: EVENT_RESUMED,
+			User: &user,
+		})
+	} else if old, ok := h.connection.Load(clientID); ok {
+		// Take over from a connection that did not notice it is gone yet
+		if u, ok := h.user.Load(clientID); ok {
+			user = u
+		}
+		roomIDs = h.joined_room_ids(clientID)
+		old.Kick("connected from another client")
+	} else if account, ok := h.user.LoadAccount(clientID); ok {
+		user.Username = account.Username
+		user.Avatar = account.Avatar
+	}
+
+	// Do not disturb is kept over a reconnect, anything else is online again
+	now := time.Now()
+	if user.Presence != DoNotDisturb {
+		user.Presence = Online
+	}
+	user.LastSeen = now.UnixNano() / int64(time.Millisecond)
+	h.presence.Choose(user.ID, user.Presence, now)
+
 	// Store connection
 	h.connection.Store(user.ID, conn)
 	// Store user
@@ -210,23 +684,41 @@ func (h *Hub) register(conn *websocket.Conn) {
 		Body: map[string]interface{}{
 			"message": "connection successful",
 			"data":    &user,
+			"token":   NewTokenSigner(h.Options.Secret).Sign(ResumeToken, user.ID, time.Now().Add(h.Options.TokenTTL)),
 		},
 		Type: CONNECTED,
 	}
 	if err := conn.WriteJSON(res); err != nil {
 		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
 			h.unregister(conn)
-			// return
+			return
+		}
+	}
+
+	// Join rooms of the resumed session again
+	for _, roomID := range roomIDs {
+		if actor, ok := h.actor(roomID); ok {
+			actor.Request(&Request{
+				ID:       uuid.New().String(),
+				ClientID: clientID,
+				Body: map[string]interface{}{
+					"roomId": roomID,
+				},
+				Type: JOIN_CHAT,
+			})
 		}
 	}
 }
 
-func (h *Hub) unregister(conn *websocket.Conn) {
+func (h *Hub) unregister(conn *Connection) {
+	if conn == nil {
+		return // already unregistered
+	}
+
 	// Read ClientID
 	var clientID string
 	{
-		tmp := conn.Locals("ClientID")
-		if str, ok := tmp.(string); ok && len(str) > 0 {
+		if str := conn.ClientID; len(str) > 0 {
 			clientID = str
 		} else {
 			h.error(conn, fiber.ErrInternalServerError)
@@ -234,6 +726,12 @@ func (h *Hub) unregister(conn *websocket.Conn) {
 		}
 	}
 
+	// Actors of several rooms may fail to write to the connection at once,
+	// only the one deleting it unregisters it
+	if !h.connection.CompareAndDelete(clientID, conn) {
+		return
+	}
+
 	// Load user
 	user, ok := h.user.Load(clientID)
 	if !ok {
@@ -241,69 +739,87 @@ func (h *Hub) unregister(conn *websocket.Conn) {
 		user.Username = "<removed>"
 	}
 
-	// If user joined a chat room than get room id
-	var roomID string
-	{
-		if room, ok := h.room.UserJoinedTo(user.ID); ok {
-			roomID = room.ID
-		}
-	}
+	// Get ids of the rooms user joined
+	roomIDs := h.joined_room_ids(user.ID)
 
-	// Leave room
-	h.room.Leave(roomID, clientID) // TODO: find a better way to handle unknown roomId situation
-	// Delete connection
-	h.connection.Delete(clientID)
-	// Delete user
-	h.user.Delete(clientID)
+	lastActive, ok := h.presence.Forget(clientID)
+	if !ok {
+		lastActive = time.Now()
+	}
 
 	// If user is removed than cannot inform who left the chat
 	if user.ID == "<removed>" {
+		h.user.Delete(clientID)
+		h.room.Leave("", clientID)
 		return
 	}
 
-	// If user joined a chat room than get user ids in that chat
-	var userIDs []string
-	{
-		if room, ok := h.room.Room(roomID); ok {
-			userIDs = room.Users
-		}
-	}
+	// Keep the profile offline and the time user was last seen
+	user.Presence = Offline
+	user.LastSeen = lastActive.UnixNano() / int64(time.Millisecond)
+	h.presence_changed(user, roomIDs)
 
-	// If user joined a chat room and there is other users in chat than inform these users
-	if len(userIDs) > 0 {
-		res := Response{
-			Body: map[string]interface{}{
-				"message": "a user lost connection",
-				"data":    &user,
-			},
-			Type: OTHER_LEFT_CHAT,
-		}
+	// Delete user
+	h.user.Delete(clientID)
 
-		for _, userID := range userIDs {
-			if c, ok := h.connection.Load(userID); ok {
-				if userID == user.ID {
-					continue // pass user itself
-				}
+	// Keep a session around for a reconnect
+	h.store_session(user, roomIDs)
 
-				if err := c.WriteJSON(res); err != nil {
-					if e := h.error(c, fiber.ErrInternalServerError); e != nil {
-						h.unregister(c)
-						// return
-						continue
-					}
-				}
-			}
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_DISCONNECTED,
+		RoomIDs: roomIDs,
+		User:    &user,
+	})
+
+	// Let every joined room leave and inform users in those chats
+	h.disconnect(user, roomIDs)
+}
+
+// disconnect hands a lost user over to the actors of the rooms it joined.
+func (h *Hub) disconnect(user User, roomIDs []string) {
+	for _, roomID := range roomIDs {
+		if actor, ok := h.actor(roomID); ok {
+			actor.Disconnect(user)
+		} else {
+			h.lost_connection(roomID, user)
 		}
 	}
 }
 
-func (h *Hub) get_rooms(conn *websocket.Conn) {
+// lost_connection removes a disconnected user from the room and informs the
+// users in that chat.
+func (h *Hub) lost_connection(roomID string, user User) {
+	h.room.Leave(roomID, user.ID)
+	h.stop_typing(roomID, user)
+
+	h.broadcast(roomID, user.ID, Response{
+		Body: map[string]interface{}{
+			"message": "a user lost connection",
+			"roomId":  roomID,
+			"data":    &user,
+		},
+		Type: OTHER_LEFT_CHAT,
+	})
+}
+
+func (h *Hub) get_rooms(conn *Connection) {
 	// Load rooms
 	rooms := h.room.Rooms()
 
+	// Count the messages user did not read yet, new messages are counted on
+	// from there
+	userID := conn.ClientID
+	unread := map[string]int{}
+	for _, room := range rooms {
+		unread[room.ID] = h.message.Unread(room.ID, userID)
+		h.unread.Set(userID, room.ID, unread[room.ID])
+	}
+
 	res := Response{
 		Body: map[string]interface{}{
-			"data": &rooms,
+			"data":   &rooms,
+			"unread": &unread,
 		},
 		Type: TOPIC_ROOMS,
 	}
@@ -348,6 +864,27 @@ func (h *Hub) change_username(req *Request) {
 		return
 	}
 
+	// Usernames of accounts are owned by them
+	if account, ok := h.user.FindAccount(username); ok && account.ID != user.ID {
+		h.error(conn, fiber.ErrConflict)
+		return
+	}
+
+	// Rename the account of a registered user
+	if account, ok := h.user.LoadAccount(user.ID); ok {
+		account.Username = username
+		if ok := h.user.StoreAccount(account); !ok {
+			h.error(conn, fiber.ErrConflict)
+			return
+		}
+
+		// Inform other processes
+		h.publish(Event{
+			Type:    EVENT_ACCOUNT_STORED,
+			Account: &account,
+		})
+	}
+
 	// Set new username
 	user.Username = username
 	h.user.Store(user.ID, user)
@@ -367,32 +904,20 @@ func (h *Hub) change_username(req *Request) {
 		}
 	}
 
-	// If user joined a chat room inform users in that chat
-	if room, ok := h.room.UserJoinedTo(user.ID); ok {
-		res := Response{
-			Body: map[string]interface{}{
-				"message": "a user changed its username",
-				"data":    &user,
-			},
-			Type: OTHER_CHANGED_USERNAME,
-		}
-
-		for _, userID := range room.Users {
-			if c, ok := h.connection.Load(userID); ok {
-				if userID == user.ID {
-					continue // pass user itself
-				}
+	// Inform other processes
+	h.publish(Event{
+		Type: EVENT_CHANGED_USERNAME,
+		User: &user,
+	})
 
-				if err := c.WriteJSON(res); err != nil {
-					if e := h.error(c, fiber.ErrInternalServerError); e != nil {
-						h.unregister(c)
-						// return
-						continue
-					}
-				}
-			}
-		}
-	}
+	// Inform users in every chat user joined
+	h.broadcast_rooms(h.joined_room_ids(user.ID), user.ID, Response{
+		Body: map[string]interface{}{
+			"message": "a user changed its username",
+			"data":    &user,
+		},
+		Type: OTHER_CHANGED_USERNAME,
+	})
 }
 
 func (h *Hub) join_chat(req *Request) {
@@ -420,12 +945,18 @@ func (h *Hub) join_chat(req *Request) {
 		}
 	}
 
+	// A resumed session may still be in the room
+	rejoined := contains(h.room.Users(roomID), req.ClientID)
+
 	// Join chat room
 	if ok := h.room.Join(roomID, req.ClientID); !ok {
 		h.error(conn, fiber.ErrBadRequest)
 		return
 	}
 
+	// The joined room is the one user looks at now
+	h.unread.Focus(req.ClientID, roomID)
+
 	// Load user
 	user, ok := h.user.Load(req.ClientID)
 	if !ok {
@@ -440,18 +971,9 @@ func (h *Hub) join_chat(req *Request) {
 		return
 	}
 
-	// Get last n messages by room
-	var messages []Message
-	for _, message := range h.message.GetLastN(roomID, h.Options.MaxReturnedMessage) {
-		// Load owner
-		owner, ok := h.user.Load(message.UserID)
-		if !ok { // TODO: handle this more user friendly way
-			owner.ID = "<removed>"
-			owner.Username = "<removed>"
-		}
-		message.User = &owner
-		messages = append(messages, message)
-	}
+	// Get last n messages by room, one more tells whether there are older
+	n := h.Options.MaxReturnedMessage
+	messages, nextCursor := h.history(h.message.GetLastN(roomID, n+1), n)
 
 	// Load online users
 	var users []User
@@ -466,9 +988,11 @@ func (h *Hub) join_chat(req *Request) {
 		Body: map[string]interface{}{
 			"message": "you joined chat",
 			"data": map[string]interface{}{
-				"room":     room,
-				"messages": &messages,
-				"users":    &users,
+				"room":       room,
+				"messages":   &messages,
+				"nextCursor": nextCursor,
+				"users":      &users,
+				"reads":      h.message.ReadPositions(roomID),
 			},
 		},
 		Type: ME_JOINED_CHAT,
@@ -481,27 +1005,26 @@ func (h *Hub) join_chat(req *Request) {
 		}
 	}
 
-	// Inform users in chat
-	res.Body = map[string]interface{}{
-		"message": "a user joined chat",
-		"data":    &user,
+	if rejoined {
+		return // others already know
 	}
-	res.Type = OTHER_JOINED_CHAT
-	for _, userID := range h.room.Users(roomID) {
-		if c, ok := h.connection.Load(userID); ok {
-			if userID == user.ID {
-				continue // pass user itself
-			}
 
-			if err := c.WriteJSON(res); err != nil {
-				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
-					h.unregister(c)
-					// return
-					continue
-				}
-			}
-		}
-	}
+	// Inform other processes
+	h.publish(Event{
+		Type:   EVENT_JOINED_CHAT,
+		RoomID: roomID,
+		User:   &user,
+	})
+
+	// Inform users in chat
+	h.broadcast(roomID, user.ID, Response{
+		Body: map[string]interface{}{
+			"message": "a user joined chat",
+			"roomId":  roomID,
+			"data":    &user,
+		},
+		Type: OTHER_JOINED_CHAT,
+	})
 }
 
 func (h *Hub) leave_chat(req *Request) {
@@ -531,6 +1054,7 @@ func (h *Hub) leave_chat(req *Request) {
 
 	// Leave chat room
 	h.room.Leave(roomID, req.ClientID)
+	h.unread.Forget(req.ClientID, roomID)
 
 	// Load user
 	user, ok := h.user.Load(req.ClientID)
@@ -538,6 +1062,7 @@ func (h *Hub) leave_chat(req *Request) {
 		h.error(conn, fiber.ErrNotFound)
 		return
 	}
+	h.stop_typing(roomID, user)
 
 	// Inform user itself here
 	res := Response{
@@ -554,27 +1079,22 @@ func (h *Hub) leave_chat(req *Request) {
 		}
 	}
 
-	// Inform users in chat
-	res.Body = map[string]interface{}{
-		"message": "a user left chat",
-		"data":    &user,
-	}
-	res.Type = OTHER_LEFT_CHAT
-	for _, userID := range h.room.Users(roomID) {
-		if c, ok := h.connection.Load(userID); ok {
-			if userID == user.ID {
-				continue // pass user itself
-			}
+	// Inform other processes
+	h.publish(Event{
+		Type:   EVENT_LEFT_CHAT,
+		RoomID: roomID,
+		User:   &user,
+	})
 
-			if err := c.WriteJSON(res); err != nil {
-				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
-					h.unregister(c)
-					// return
-					continue
-				}
-			}
-		}
-	}
+	// Inform users in chat
+	h.broadcast(roomID, user.ID, Response{
+		Body: map[string]interface{}{
+			"message": "a user left chat",
+			"roomId":  roomID,
+			"data":    &user,
+		},
+		Type: OTHER_LEFT_CHAT,
+	})
 }
 
 func (h *Hub) send_message(req *Request) {
@@ -606,7 +1126,7 @@ func (h *Hub) send_message(req *Request) {
 	var message string
 	{
 		if tmp, ok := req.Body["message"]; ok {
-			if s, ok := tmp.(string); ok { // TODO: validate data. e.g., not empty
+			if s, ok := tmp.(string); ok {
 				message = s
 			} else {
 				h.error(conn, fiber.ErrBadRequest)
@@ -617,21 +1137,70 @@ func (h *Hub) send_message(req *Request) {
 			return
 		}
 	}
+	if err := validateMessage(message, attachmentCount(req)); err != nil {
+		h.error(conn, err)
+		return
+	}
 
-	// Remove old messages
-	if h.message.Count(roomID) >= h.Options.MaxSavedMessage {
-		h.message.Set(roomID, h.message.Get(roomID)[1:])
+	// Read optional parentId from request body, a reply goes to a thread
+	var parentID string
+	if tmp, ok := req.Body["parentId"]; ok {
+		s, ok := tmp.(string)
+		if !ok {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+		parentID = s
 	}
 
-	// Save new message
-	newMessage := Message{
-		ID:        req.ID,
-		UserID:    req.ClientID,
-		RoomID:    roomID,
-		Message:   message,
-		Timestamp: time.Now().Unix() * 1000, // in ms
+	// Read optional replyToId from request body, the message to quote
+	var replyToID string
+	if tmp, ok := req.Body["replyToId"]; ok {
+		s, ok := tmp.(string)
+		if !ok {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+		replyToID = s
+	}
+
+	// The room may have been deleted meanwhile
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Only messages of the same room can be quoted
+	var replyTo *Quote
+	if replyToID != "" {
+		original, ok := h.message.Load(roomID, replyToID)
+		if !ok {
+			h.error(conn, fiber.ErrNotFound)
+			return
+		}
+		if original.DeletedAt != 0 {
+			h.error(conn, fiber.ErrGone)
+			return
+		}
+		replyTo = original.quote(h.author(original))
+	}
+
+	// Threads are one level deep, replying to a reply joins its thread
+	if parentID != "" {
+		parent, ok := h.message.Load(roomID, parentID)
+		if !ok {
+			h.error(conn, fiber.ErrNotFound)
+			return
+		}
+		if parent.DeletedAt != 0 {
+			h.error(conn, fiber.ErrGone)
+			return
+		}
+		if parent.ParentID != "" {
+			parentID = parent.ParentID
+		}
 	}
-	h.message.Append(roomID, newMessage)
 
 	// Load user
 	user, ok := h.user.Load(req.ClientID)
@@ -640,6 +1209,46 @@ func (h *Hub) send_message(req *Request) {
 		return
 	}
 
+	// Files uploaded beforehand go with the message
+	attachments, err := h.attachments(req, roomID)
+	if err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	// Save new message along with its author
+	newMessage := Message{
+		ID:          req.ID,
+		UserID:      req.ClientID,
+		User:        &user,
+		RoomID:      roomID,
+		Message:     message,
+		Timestamp:   time.Now().Unix() * 1000, // in ms
+		ParentID:    parentID,
+		ReplyTo:     replyTo,
+		Mentions:    h.mentions(message),
+		Attachments: attachments,
+	}
+	h.message.Append(roomID, newMessage)
+
+	// Remove old messages
+	h.trim(roomID, h.Options.MaxSavedMessage)
+
+	// Sending ends typing
+	h.stop_typing(roomID, user)
+
+	// Replies stay out of the main timeline and unread counts
+	if newMessage.ParentID != "" {
+		h.publish(Event{
+			Type:    EVENT_MESSAGE_SEND,
+			RoomID:  roomID,
+			Message: &newMessage,
+		})
+		h.thread_reply(room, &newMessage)
+		h.notify_mentioned(&newMessage)
+		return
+	}
+
 	// Inform user itself here
 	res := Response{
 		Body: map[string]interface{}{
@@ -655,27 +1264,42 @@ func (h *Hub) send_message(req *Request) {
 		}
 	}
 
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_MESSAGE_SEND,
+		RoomID:  roomID,
+		Message: &newMessage,
+	})
+
 	// Inform users in chat
 	res.Type = OTHER_MESSAGE_SEND
-	newMessage.User = &user
-	for _, userID := range h.room.Users(roomID) {
-		if c, ok := h.connection.Load(userID); ok {
-			if userID == user.ID {
-				continue // pass user itself
-			}
+	h.broadcast(roomID, user.ID, res)
 
-			if err := c.WriteJSON(res); err != nil {
-				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
-					h.unregister(c)
-					// return
-					continue
-				}
-			}
-		}
+	// Count the message for members looking at another room
+	h.count_unread(roomID, user.ID)
+
+	// Tell mentioned users wherever they are
+	h.notify_mentioned(&newMessage)
+}
+
+// thread_reply informs users in chat, the author included, about a reply and
+// the new reply count of its parent.
+func (h *Hub) thread_reply(room Room, reply *Message) {
+	var replyCount int
+	if parent, ok := h.message.Load(room.ID, reply.ParentID); ok {
+		replyCount = parent.ReplyCount
 	}
+
+	h.notify_room(room, Response{
+		Body: map[string]interface{}{
+			"data":       reply,
+			"replyCount": replyCount,
+		},
+		Type: THREAD_REPLY,
+	})
 }
 
-func (h *Hub) old_messages(req *Request) {
+func (h *Hub) thread_messages(req *Request) {
 	// Load connection
 	conn, ok := h.connection.Load(req.ClientID)
 	if !ok {
@@ -684,66 +1308,49 @@ func (h *Hub) old_messages(req *Request) {
 		return
 	}
 
-	// Read roomId from request body
-	var (
-		roomID      string
-		oldestMsgID string
-	)
-	{
-		if tmp, ok := req.Body["roomId"]; ok {
-			if s, ok := tmp.(string); ok { // TODO: validate data. e.g., not empty
-				roomID = s
-			} else {
-				h.error(conn, fiber.ErrBadRequest)
-				return
-			}
-		} else {
-			h.error(conn, fiber.ErrBadRequest)
-			return
-		}
+	// Read roomId and parentId from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	parentID, okParent := req.Body["parentId"].(string)
+	if !okRoom || !okParent {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
 
-		if tmp, ok := req.Body["oldestMsgId"]; ok {
-			if s, ok := tmp.(string); ok { // TODO: validate data. e.g., not empty
-				oldestMsgID = s
-			} else {
-				h.error(conn, fiber.ErrBadRequest)
-				return
-			}
-		} else {
+	// Read optional oldestMsgId from request body, the newest replies come
+	// first
+	var oldestMsgID []string
+	if tmp, ok := req.Body["oldestMsgId"]; ok {
+		s, ok := tmp.(string)
+		if !ok {
 			h.error(conn, fiber.ErrBadRequest)
 			return
 		}
+		oldestMsgID = append(oldestMsgID, s)
 	}
 
-	// Load room
-	room, ok := h.room.Room(roomID)
+	// Load parent
+	parent, ok := h.message.Load(roomID, parentID)
 	if !ok {
 		h.error(conn, fiber.ErrNotFound)
 		return
 	}
+	parent.User = h.author(parent)
 
-	// Get last n messages by room older than oldestMsgID
+	// Get last n replies older than oldestMsgID
 	var messages []Message
-	for _, message := range h.message.GetLastN(roomID, h.Options.MaxReturnedMessage, oldestMsgID) {
-		// Load owner
-		owner, ok := h.user.Load(message.UserID)
-		if !ok { // TODO: handle this more user friendly way
-			owner.ID = "<removed>"
-			owner.Username = "<removed>"
-		}
-		message.User = &owner
+	for _, message := range h.message.GetThread(roomID, parentID, h.Options.MaxReturnedMessage, oldestMsgID...) {
+		message.User = h.author(message)
 		messages = append(messages, message)
 	}
 
-	// Inform user itself here and send room info and last n messages back
 	res := Response{
 		Body: map[string]interface{}{
 			"data": map[string]interface{}{
-				"room":     room,
+				"parent":   &parent,
 				"messages": &messages,
 			},
 		},
-		Type: OLD_MESSAGES,
+		Type: THREAD_MESSAGES,
 	}
 
 	if err := conn.WriteJSON(res); err != nil {
@@ -754,7 +1361,1197 @@ func (h *Hub) old_messages(req *Request) {
 	}
 }
 
-func (h *Hub) error(conn *websocket.Conn, err error) error {
+func (h *Hub) edit_message(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId, messageId and message from request body
+	var roomID, msgID, text string
+	{
+		tmpRoom, okRoom := req.Body["roomId"].(string)
+		tmpID, okID := req.Body["messageId"].(string)
+		tmpText, okText := req.Body["message"].(string)
+		if !okRoom || !okID || !okText {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+		roomID, msgID, text = tmpRoom, tmpID, tmpText
+	}
+	if err := validateMessage(text, 0); err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	// Load room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Load message
+	message, ok := h.message.Load(roomID, msgID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Deleted messages stay deleted
+	if message.DeletedAt != 0 {
+		h.error(conn, fiber.ErrGone)
+		return
+	}
+
+	// Only the author may edit, and only for a while
+	if message.UserID != req.ClientID {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if window := h.Options.EditWindow; window > 0 && now-message.Timestamp > window.Milliseconds() {
+		h.error(conn, ErrEditWindowPassed)
+		return
+	}
+
+	// Keep edits ordered, stores ignore ones not newer than the last
+	editedAt := now
+	if editedAt <= message.EditedAt {
+		editedAt = message.EditedAt + 1
+	}
+
+	// Save new text, the old one is kept as a revision. Mentions follow the
+	// text but are not notified again.
+	message, ok = h.message.Edit(roomID, msgID, text, h.mentions(text), editedAt)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		return
+	}
+	message.User = h.author(message)
+
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_MESSAGE_EDITED,
+		RoomID:  roomID,
+		Message: &message,
+	})
+
+	// Inform users in chat, the author included
+	h.notify_room(room, Response{
+		Body: map[string]interface{}{
+			"data": &message,
+		},
+		Type: MESSAGE_EDITED,
+	})
+}
+
+func (h *Hub) delete_message(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and messageId from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	msgID, okID := req.Body["messageId"].(string)
+	if !okRoom || !okID {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Load message
+	message, ok := h.message.Load(roomID, msgID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if message.DeletedAt != 0 {
+		h.error(conn, fiber.ErrGone)
+		return
+	}
+
+	// Authors delete their own messages, moderators anyone's
+	if message.UserID != req.ClientID && !h.moderates(room, req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+
+	// Leave a tombstone behind
+	attachments := message.Attachments
+	message, ok = h.message.Delete(roomID, msgID, time.Now().UnixNano()/int64(time.Millisecond))
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		return
+	}
+	message.User = h.author(message)
+
+	// The tombstone keeps no attachments, neither does the store, so what
+	// was removed can not be downloaded anymore
+	for _, attachment := range attachments {
+		if err := h.attachment.Remove(attachment); err != nil {
+			log.Printf("%#v\n", err)
+		}
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_MESSAGE_DELETED,
+		RoomID:  roomID,
+		Message: &message,
+	})
+
+	// Inform users in chat, the one who deleted included
+	h.notify_room(room, Response{
+		Body: map[string]interface{}{
+			"data": &message,
+		},
+		Type: MESSAGE_DELETED,
+	})
+}
+
+func (h *Hub) react(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId, messageId and emoji from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	msgID, okID := req.Body["messageId"].(string)
+	emoji, okEmoji := req.Body["emoji"].(string)
+	if !okRoom || !okID || !okEmoji {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+	if emoji == "" || len(emoji) > MaxReactionLength {
+		h.error(conn, fiber.NewError(fiber.StatusBadRequest, "emoji must be 1 to 32 bytes"))
+		return
+	}
+
+	// Load room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Add or remove the reaction, both are harmless to repeat
+	var message Message
+	added := req.Type == ADD_REACTION
+	if added {
+		message, ok = h.message.AddReaction(roomID, msgID, emoji, req.ClientID)
+	} else {
+		message, ok = h.message.RemoveReaction(roomID, msgID, emoji, req.ClientID)
+	}
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if message.DeletedAt != 0 {
+		h.error(conn, fiber.ErrGone)
+		return
+	}
+
+	reaction := Reaction{
+		RoomID:    roomID,
+		MessageID: msgID,
+		Emoji:     emoji,
+		UserID:    req.ClientID,
+		Added:     added,
+		UserIDs:   message.Reactions[emoji],
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:     EVENT_REACTION_CHANGED,
+		RoomID:   roomID,
+		Reaction: &reaction,
+	})
+
+	// Inform users in chat, the one who reacted included
+	h.notify_room(room, Response{
+		Body: map[string]interface{}{
+			"data": &reaction,
+		},
+		Type: REACTION_CHANGED,
+	})
+}
+
+func (h *Hub) mark_read(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and messageId from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	msgID, okID := req.Body["messageId"].(string)
+	if !okRoom || !okID {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load room, only its members read a direct room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if room.Type == DirectRoom && !contains(room.Members, req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+
+	// Load message, replies are read in their thread
+	message, ok := h.message.Load(roomID, msgID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if message.ParentID != "" {
+		h.error(conn, fiber.NewError(fiber.StatusBadRequest, "replies have no read position"))
+		return
+	}
+
+	// Load user
+	user, ok := h.user.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Positions only move forward, an older receipt just gets the count back
+	if h.message.MarkRead(roomID, user.ID, msgID) {
+		// Inform other processes
+		h.publish(Event{
+			Type:    EVENT_READ_POSITION,
+			RoomID:  roomID,
+			User:    &user,
+			Message: &Message{ID: msgID},
+		})
+
+		// Inform users in chat, the reader included
+		h.notify_room(room, Response{
+			Body: map[string]interface{}{
+				"roomId":    roomID,
+				"messageId": msgID,
+				"data":      &user,
+			},
+			Type: READ_POSITION,
+		})
+	}
+
+	// Send the count of messages left unread back
+	count := h.message.Unread(roomID, user.ID)
+	h.unread.Set(user.ID, roomID, count)
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]int{
+				roomID: count,
+			},
+		},
+		Type: UNREAD_COUNTS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// moderates reports whether userID may remove anyone's messages in room.
+func (h *Hub) moderates(room Room, userID string) bool {
+	if room.OwnerID != "" && room.OwnerID == userID {
+		return true
+	}
+	return contains(h.Options.Moderators, userID)
+}
+
+func (h *Hub) message_revisions(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and messageId from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	msgID, okID := req.Body["messageId"].(string)
+	if !okRoom || !okID {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load message
+	if _, ok := h.message.Load(roomID, msgID); !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	revisions := h.message.Revisions(roomID, msgID)
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]interface{}{
+				"roomId":    roomID,
+				"messageId": msgID,
+				"revisions": &revisions,
+			},
+		},
+		Type: MESSAGE_REVISIONS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// count_unread counts a new message of a room for its members connected here
+// and sends them the new unread count of the room.
+func (h *Hub) count_unread(roomID string, senderID string) {
+	for _, userID := range h.room.Users(roomID) {
+		if userID == senderID {
+			continue
+		}
+		c, ok := h.connection.Load(userID)
+		if !ok {
+			continue // counted by the process it is connected to
+		}
+
+		count := h.unread.Add(userID, roomID)
+		if count == 0 {
+			continue // looking at the room
+		}
+
+		res := Response{
+			Body: map[string]interface{}{
+				"data": map[string]int{
+					roomID: count,
+				},
+			},
+			Type: UNREAD_COUNTS,
+		}
+		if err := c.WriteJSON(res); err != nil {
+			if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+				h.unregister(c)
+			}
+		}
+	}
+}
+
+func (h *Hub) focus_room(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId from request body, empty to focus no room
+	roomID, ok := req.Body["roomId"].(string)
+	if !ok {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Only joined rooms can be looked at
+	if roomID != "" && !contains(h.room.Users(roomID), req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+	h.unread.Focus(req.ClientID, roomID)
+
+	// Send counts of every room back
+	counts := h.unread.Counts(req.ClientID)
+	res := Response{
+		Body: map[string]interface{}{
+			"data": &counts,
+		},
+		Type: UNREAD_COUNTS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+func (h *Hub) old_messages(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and cursor from request body, clients predating cursors
+	// send oldestMsgId instead
+	roomID, okRoom := req.Body["roomId"].(string)
+	tmpCursor, okCursor := req.optionalString("cursor")
+	oldestMsgID, okID := req.optionalString("oldestMsgId")
+	if !okRoom || !okCursor || !okID || (tmpCursor == "") == (oldestMsgID == "") {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	var cursor Cursor
+	if tmpCursor != "" {
+		var err error
+		if cursor, err = ParseCursor(tmpCursor); err != nil {
+			h.error(conn, err)
+			return
+		}
+	} else if message, ok := h.message.Load(roomID, oldestMsgID); ok {
+		cursor = CursorOf(message)
+	} else {
+		h.error(conn, ErrCursorExpired)
+		return
+	}
+
+	// Get last n messages by room older than the cursor, one more tells
+	// whether there are more. Trimmed history is not served from the newest
+	// again.
+	n := h.Options.MaxReturnedMessage
+	older, ok := h.message.GetBefore(roomID, n+1, cursor)
+	if !ok {
+		h.error(conn, ErrCursorExpired)
+		return
+	}
+	messages, nextCursor := h.history(older, n)
+
+	// Inform user itself here and send room info and last n messages back
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]interface{}{
+				"room":       room,
+				"messages":   &messages,
+				"nextCursor": nextCursor,
+			},
+		},
+		Type: OLD_MESSAGES,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// messages_around sends the messages of the main timeline around a message,
+// e.g. a search hit, or around a point in time. A reply is shown around its
+// parent.
+func (h *Hub) messages_around(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and either messageId or timestamp from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	msgID, okID := req.optionalString("messageId")
+	timestamp, okTime := req.optionalNumber("timestamp")
+	if !okRoom || !okID || !okTime || (msgID == "") == (timestamp == 0) {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load room, only its members read a direct room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if room.Type == DirectRoom && !contains(room.Members, req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+
+	// Find the message the window is around
+	var anchor Message
+	if msgID != "" {
+		anchor, ok = h.message.Load(roomID, msgID)
+		if ok && anchor.ParentID != "" {
+			anchor, ok = h.message.Load(roomID, anchor.ParentID)
+		}
+		if !ok {
+			h.error(conn, fiber.ErrNotFound)
+			return
+		}
+	} else {
+		anchor, ok = h.message.Seek(roomID, int64(timestamp))
+	}
+
+	// Half of the window is older than the anchor, asking one more in each
+	// direction tells whether there are more
+	n := h.Options.MaxReturnedMessage
+	before := n / 2
+	var older, newer []Message
+	if ok {
+		older = h.message.GetLastN(roomID, before+1, anchor.ID)
+	} else {
+		// Nothing is that new, the newest messages are the closest
+		before = n
+		older = h.message.GetLastN(roomID, before+1)
+	}
+	hasOlder := len(older) > before
+	if hasOlder {
+		older = older[1:]
+	}
+	hasNewer := false
+	if ok {
+		older = append(older, anchor)
+		after := n - len(older)
+		newer = h.message.GetNextN(roomID, after+1, anchor.ID)
+		hasNewer = len(newer) > after
+		if hasNewer {
+			newer = newer[:after]
+		}
+	}
+
+	// Older pages start at the oldest message returned, the anchor itself
+	// when the window has no room for any before it
+	nextCursor := ""
+	if hasOlder && len(older) > 0 {
+		nextCursor = CursorOf(older[0]).String()
+	}
+
+	var messages []Message
+	for _, message := range append(older, newer...) {
+		message.User = h.author(message)
+		messages = append(messages, message)
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]interface{}{
+				"room":       room,
+				"messages":   &messages,
+				"anchorId":   anchor.ID,
+				"hasOlder":   hasOlder,
+				"hasNewer":   hasNewer,
+				"nextCursor": nextCursor,
+			},
+		},
+		Type: MESSAGES_AROUND,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// newer_messages pages forward from a window opened by messages_around.
+func (h *Hub) newer_messages(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and newestMsgId from request body
+	roomID, okRoom := req.Body["roomId"].(string)
+	newestMsgID, okID := req.Body["newestMsgId"].(string)
+	if !okRoom || !okID {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load room, only its members read a direct room
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if room.Type == DirectRoom && !contains(room.Members, req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+	if _, ok := h.message.Load(roomID, newestMsgID); !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	// Get next n messages newer than newestMsgID, one more tells whether
+	// there are more
+	n := h.Options.MaxReturnedMessage
+	newer := h.message.GetNextN(roomID, n+1, newestMsgID)
+	hasNewer := len(newer) > n
+	if hasNewer {
+		newer = newer[:n]
+	}
+
+	var messages []Message
+	for _, message := range newer {
+		message.User = h.author(message)
+		messages = append(messages, message)
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": map[string]interface{}{
+				"room":     room,
+				"messages": &messages,
+				"hasNewer": hasNewer,
+			},
+		},
+		Type: NEWER_MESSAGES,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// create_room creates a public room named by the user and lists it for all.
+func (h *Hub) create_room(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read name from request body
+	var name string
+	{
+		if tmp, ok := req.Body["name"]; ok {
+			if s, ok := tmp.(string); ok {
+				name = strings.TrimSpace(s)
+			} else {
+				h.error(conn, fiber.ErrBadRequest)
+				return
+			}
+		} else {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+	}
+	if err := validateRoomName(name); err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		h.error(conn, fiber.ErrInternalServerError)
+		return
+	}
+
+	// Create room
+	room := Room{
+		ID:      id.String(),
+		Name:    name,
+		Type:    TopicRoom,
+		OwnerID: req.ClientID,
+	}
+	if ok := h.room.Add(room); !ok {
+		h.error(conn, ErrRoomNameTaken)
+		return
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type: EVENT_ROOM_CREATED,
+		Room: &room,
+	})
+
+	// Inform everyone, the creator included
+	h.rooms_changed("a room is created", room)
+}
+
+func (h *Hub) rename_room(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId and name from request body
+	var roomID, name string
+	{
+		tmpID, okID := req.Body["roomId"].(string)
+		tmpName, okName := req.Body["name"].(string)
+		if !okID || !okName {
+			h.error(conn, fiber.ErrBadRequest)
+			return
+		}
+		roomID, name = tmpID, strings.TrimSpace(tmpName)
+	}
+	if err := validateRoomName(name); err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	// Only the creator may rename a room
+	room, ok := h.owned_room(conn, req.ClientID, roomID)
+	if !ok {
+		return
+	}
+
+	// Rename room
+	if ok := h.room.Rename(roomID, name); !ok {
+		h.error(conn, ErrRoomNameTaken)
+		return
+	}
+	room.Name = name
+
+	// Inform other processes
+	h.publish(Event{
+		Type: EVENT_ROOM_RENAMED,
+		Room: &room,
+	})
+
+	// Inform everyone, the owner included
+	h.rooms_changed("a room is renamed", room)
+}
+
+func (h *Hub) delete_room(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId from request body
+	roomID, ok := req.Body["roomId"].(string)
+	if !ok {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Only the creator may delete a room
+	room, ok := h.owned_room(conn, req.ClientID, roomID)
+	if !ok {
+		return
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type: EVENT_ROOM_DELETED,
+		Room: &room,
+	})
+
+	h.drop_room(room)
+}
+
+// owned_room loads a room and reports an error to conn unless userID owns it.
+func (h *Hub) owned_room(conn *Connection, userID string, roomID string) (room Room, ok bool) {
+	room, ok = h.room.Room(roomID)
+	if !ok || room.Type != TopicRoom {
+		h.error(conn, fiber.ErrNotFound)
+		return room, false
+	}
+	if room.OwnerID == "" || room.OwnerID != userID {
+		h.error(conn, fiber.ErrForbidden)
+		return room, false
+	}
+	return room, true
+}
+
+// drop_room deletes a room, tells its members they are out and informs
+// everyone that the room list changed. The room's actor finishes what is
+// already queued before its messages, unread counts and typing state are
+// removed.
+func (h *Hub) drop_room(room Room) {
+	h.broadcast(room.ID, "", Response{
+		Body: map[string]interface{}{
+			"message": "the room is deleted",
+			"data":    &room,
+		},
+		Type: ME_LEFT_CHAT,
+	})
+
+	h.room.Delete(room.ID)
+
+	h.actorsLock.Lock()
+	actor, ok := h.actors[room.ID]
+	delete(h.actors, room.ID)
+	h.actorsLock.Unlock()
+
+	forget := func() {
+		h.trim(room.ID, 0)
+		h.unread.ForgetRoom(room.ID)
+		h.typing.ForgetRoom(room.ID)
+	}
+	if ok {
+		actor.Close(forget)
+	} else {
+		forget()
+	}
+
+	h.rooms_changed("a room is deleted", room)
+}
+
+// trim drops the oldest messages of a room so at most max are kept, along
+// with the files of their attachments, which would otherwise stay on disk and
+// count against their uploader's quota.
+func (h *Hub) trim(roomID string, max int) {
+	for _, attachment := range h.message.Trim(roomID, max) {
+		if err := h.attachment.Remove(attachment); err != nil {
+			log.Printf("%#v\n", err)
+		}
+	}
+}
+
+// rooms_changed sends the new room list to every connection.
+func (h *Hub) rooms_changed(message string, room Room) {
+	rooms := h.room.Rooms()
+
+	res := Response{
+		Body: map[string]interface{}{
+			"message": message,
+			"room":    &room,
+			"data":    &rooms,
+		},
+		Type: ROOMS_CHANGED,
+	}
+
+	h.connection.Range(func(clientID string, c *Connection) {
+		if err := c.WriteJSON(res); err != nil {
+			if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+				h.unregister(c)
+			}
+		}
+	})
+}
+
+var (
+	ErrRoomNameTaken    = fiber.NewError(fiber.StatusConflict, "room name is taken")
+	ErrEditWindowPassed = fiber.NewError(fiber.StatusForbidden, "message can no longer be edited")
+)
+
+// validateRoomName counts characters rather than bytes, so names in other
+// scripts get the same length as latin ones.
+func validateRoomName(name string) error {
+	if l := utf8.RuneCountInString(strings.TrimSpace(name)); l < MinRoomNameLength || l > MaxRoomNameLength {
+		return fiber.NewError(fiber.StatusBadRequest, "room name must be 3 to 32 characters")
+	}
+	return nil
+}
+
+// remote_event mirrors a change made by a hub in another process and informs
+// the users connected to this one.
+func (h *Hub) remote_event(event Event) {
+	if event.Node == h.node {
+		return // already handled locally
+	}
+
+	switch event.Type {
+
+	case EVENT_JOINED_CHAT:
+		h.user.Store(event.User.ID, *event.User)
+		h.room.Join(event.RoomID, event.User.ID)
+		h.broadcast(event.RoomID, event.User.ID, Response{
+			Body: map[string]interface{}{
+				"message": "a user joined chat",
+				"roomId":  event.RoomID,
+				"data":    event.User,
+			},
+			Type: OTHER_JOINED_CHAT,
+		})
+
+	case EVENT_LEFT_CHAT:
+		h.room.Leave(event.RoomID, event.User.ID)
+		h.broadcast(event.RoomID, event.User.ID, Response{
+			Body: map[string]interface{}{
+				"message": "a user left chat",
+				"roomId":  event.RoomID,
+				"data":    event.User,
+			},
+			Type: OTHER_LEFT_CHAT,
+		})
+
+	case EVENT_DISCONNECTED:
+		h.user.Delete(event.User.ID)
+		h.store_session(*event.User, event.RoomIDs)
+		h.disconnect(*event.User, event.RoomIDs)
+
+	case EVENT_RESUMED:
+		h.session.Delete(event.User.ID)
+
+	case EVENT_ACCOUNT_STORED:
+		h.user.StoreAccount(*event.Account)
+
+	case EVENT_CHANGED_USERNAME:
+		h.user.Store(event.User.ID, *event.User)
+		h.broadcast_rooms(h.joined_room_ids(event.User.ID), event.User.ID, Response{
+			Body: map[string]interface{}{
+				"message": "a user changed its username",
+				"data":    event.User,
+			},
+			Type: OTHER_CHANGED_USERNAME,
+		})
+
+	case EVENT_MESSAGE_SEND:
+		h.message.Append(event.RoomID, *event.Message)
+		h.trim(event.RoomID, h.Options.MaxSavedMessage)
+
+		if event.Message.ParentID != "" {
+			if room, ok := h.room.Room(event.RoomID); ok {
+				h.thread_reply(room, event.Message)
+			}
+			h.notify_mentioned(event.Message)
+			break
+		}
+
+		h.broadcast(event.RoomID, event.Message.UserID, Response{
+			Body: map[string]interface{}{
+				"data": event.Message,
+			},
+			Type: OTHER_MESSAGE_SEND,
+		})
+		h.count_unread(event.RoomID, event.Message.UserID)
+		h.notify_mentioned(event.Message)
+
+	case EVENT_MESSAGE_EDITED:
+		h.message.Edit(event.RoomID, event.Message.ID, event.Message.Message, event.Message.Mentions, event.Message.EditedAt)
+		if room, ok := h.room.Room(event.RoomID); ok {
+			h.notify_room(room, Response{
+				Body: map[string]interface{}{
+					"data": event.Message,
+				},
+				Type: MESSAGE_EDITED,
+			})
+		}
+
+	case EVENT_MESSAGE_DELETED:
+		h.message.Delete(event.RoomID, event.Message.ID, event.Message.DeletedAt)
+		if room, ok := h.room.Room(event.RoomID); ok {
+			h.notify_room(room, Response{
+				Body: map[string]interface{}{
+					"data": event.Message,
+				},
+				Type: MESSAGE_DELETED,
+			})
+		}
+
+	case EVENT_REACTION_CHANGED:
+		r := event.Reaction
+		if r.Added {
+			h.message.AddReaction(r.RoomID, r.MessageID, r.Emoji, r.UserID)
+		} else {
+			h.message.RemoveReaction(r.RoomID, r.MessageID, r.Emoji, r.UserID)
+		}
+		if room, ok := h.room.Room(event.RoomID); ok {
+			h.notify_room(room, Response{
+				Body: map[string]interface{}{
+					"data": r,
+				},
+				Type: REACTION_CHANGED,
+			})
+		}
+
+	case EVENT_TYPING_STARTED, EVENT_TYPING_STOPPED:
+		h.relay_typing(event.RoomID, *event.User, event.Type == EVENT_TYPING_STARTED)
+
+	case EVENT_PRESENCE_CHANGED:
+		h.user.Store(event.User.ID, *event.User)
+		h.broadcast_rooms(event.RoomIDs, event.User.ID, Response{
+			Body: map[string]interface{}{
+				"data": event.User,
+			},
+			Type: PRESENCE_CHANGED,
+		})
+
+	case EVENT_READ_POSITION:
+		h.message.MarkRead(event.RoomID, event.User.ID, event.Message.ID)
+		if room, ok := h.room.Room(event.RoomID); ok {
+			h.notify_room(room, Response{
+				Body: map[string]interface{}{
+					"roomId":    event.RoomID,
+					"messageId": event.Message.ID,
+					"data":      event.User,
+				},
+				Type: READ_POSITION,
+			})
+		}
+
+	case EVENT_ROOM_CREATED:
+		h.room.Add(*event.Room)
+		h.rooms_changed("a room is created", *event.Room)
+
+	case EVENT_ROOM_RENAMED:
+		h.room.Rename(event.Room.ID, event.Room.Name)
+		h.rooms_changed("a room is renamed", *event.Room)
+
+	case EVENT_ROOM_DELETED:
+		h.drop_room(*event.Room)
+
+	case EVENT_DIRECT_MESSAGE_SEND:
+		h.room.Add(*event.Room)
+		h.message.Append(event.Room.ID, *event.Message)
+		h.trim(event.Room.ID, h.Options.MaxSavedMessage)
+
+		for _, id := range event.Room.Members {
+			if id != event.Message.UserID {
+				h.deliver_direct(id, event.Message)
+			}
+		}
+	}
+}
+
+// author resolves who wrote a message: the current profile if the author is
+// still known, else the snapshot stored with the message.
+func (h *Hub) author(message Message) *User {
+	if user, ok := h.user.Profile(message.UserID); ok {
+		return &user
+	}
+	if message.User != nil {
+		return message.User
+	}
+	return &User{
+		ID:       message.UserID,
+		Username: "<removed>",
+	}
+}
+
+// store_session keeps what a disconnected user needs to resume within the grace
+// window.
+func (h *Hub) store_session(user User, roomIDs []string) {
+	h.session.Store(user.ID, Session{
+		User:    user,
+		RoomIDs: roomIDs,
+		Expires: time.Now().Add(h.Options.ResumeGrace),
+	})
+}
+
+func (h *Hub) joined_room_ids(userID string) []string {
+	var roomIDs []string
+	for _, room := range h.room.JoinedRooms(userID) {
+		roomIDs = append(roomIDs, room.ID)
+	}
+	return roomIDs
+}
+
+// publish informs hubs in other processes about a local change.
+func (h *Hub) publish(event Event) {
+	event.Node = h.node
+	if err := h.Broker.Publish(event); err != nil {
+		log.Printf("%#v\n", err)
+	}
+}
+
+// broadcast sends res to every connection in the room except exceptUserID's.
+func (h *Hub) broadcast(roomID string, exceptUserID string, res Response) {
+	for _, userID := range h.room.Users(roomID) {
+		if userID == exceptUserID {
+			continue // pass user itself
+		}
+
+		if c, ok := h.connection.Load(userID); ok {
+			if err := c.WriteJSON(res); err != nil {
+				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+					h.unregister(c)
+					continue
+				}
+			}
+		}
+	}
+}
+
+// notify_room sends res to everyone in a room: the joined users of a topic
+// room or the members of a direct room.
+func (h *Hub) notify_room(room Room, res Response) {
+	if room.Type != DirectRoom {
+		h.broadcast(room.ID, "", res)
+		return
+	}
+
+	for _, userID := range room.Members {
+		if c, ok := h.connection.Load(userID); ok {
+			if err := c.WriteJSON(res); err != nil {
+				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+					h.unregister(c)
+				}
+			}
+		}
+	}
+}
+
+// broadcast_rooms sends res once to every user sharing a room with
+// exceptUserID.
+func (h *Hub) broadcast_rooms(roomIDs []string, exceptUserID string, res Response) {
+	sent := map[string]bool{exceptUserID: true}
+	for _, roomID := range roomIDs {
+		for _, userID := range h.room.Users(roomID) {
+			if sent[userID] {
+				continue
+			}
+			sent[userID] = true
+
+			if c, ok := h.connection.Load(userID); ok {
+				if err := c.WriteJSON(res); err != nil {
+					if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+						h.unregister(c)
+						continue
+					}
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) error(conn *Connection, err error) error {
+	if conn == nil {
+		return ErrConnectionClosed
+	}
+
 	res := Response{
 		Error: map[string]interface{}{
 			"message": err.Error(),
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -13,6 +17,11 @@ import (
 func main() {
 	addr := flag.String("addr", ":8080", "http service address")
 	debug := flag.Bool("debug", false, "run in debug mode")
+	storage := flag.String("storage", string(MemoryDriver), "storage driver: memory, sqlite or bolt")
+	db := flag.String("db", "chat.db", "database file used by the sqlite and bolt storage drivers")
+	uploads := flag.String("uploads", "uploads", "directory uploaded attachments are stored in")
+	brokerPath := flag.String("broker", "", "unix socket the prefork processes share events through (defaults to one in the temp dir)")
+	moderators := flag.String("moderators", "", "comma separated account ids allowed to moderate every room")
 	flag.Parse()
 
 	fiberConf := fiber.Config{
@@ -32,10 +41,72 @@ func main() {
 		wsConf.Origins = []string{"*"}
 	}
 
-	app := fiber.New(fiberConf)
+	// bolt allows a single process to open the file
+	if StorageDriver(*storage) == BoltDriver {
+		fiberConf.Prefork = false
+	}
 
 	hub := NewHub()
-	hub.Defaults()
+	if err := hub.Defaults(StorageOptions{
+		Driver:        StorageDriver(*storage),
+		Path:          *db,
+		AttachmentDir: *uploads,
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	// Uploads need room for the largest attachment and the multipart framing
+	// around it
+	fiberConf.BodyLimit = int(hub.Options.MaxAttachmentSize) + 64<<10
+
+	app := fiber.New(fiberConf)
+
+	if *moderators != "" {
+		hub.Options.Moderators = strings.Split(*moderators, ",")
+	}
+
+	// Tokens must verify in whichever prefork child a client reconnects to, so
+	// the master picks a secret that the children inherit through the env
+	if secret := os.Getenv("CHAT_SECRET"); secret != "" {
+		hub.Options.Secret = []byte(secret)
+	} else if fiberConf.Prefork && !fiber.IsChild() {
+		os.Setenv("CHAT_SECRET", hex.EncodeToString(hub.Options.Secret))
+	}
+
+	// Every prefork child has its own hub, so they fan events out through a
+	// relay run by the master process
+	var relay *UnixBrokerRelay
+	if fiberConf.Prefork {
+		path := *brokerPath
+		if path == "" {
+			pid := os.Getpid()
+			if fiber.IsChild() {
+				pid = os.Getppid()
+			}
+			path = filepath.Join(os.TempDir(), fmt.Sprintf("chat-app-%d.sock", pid))
+		}
+
+		if fiber.IsChild() {
+			broker, err := DialUnixBroker(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			hub.Broker = broker
+		} else {
+			var err error
+			if relay, err = ListenUnixBroker(path); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	app.Get("/api/metrics", hub.Metrics)
+	app.Post("/api/auth/register", hub.RegisterAccount)
+	app.Post("/api/auth/login", hub.Login)
+	app.Get("/api/messages/search", hub.SearchMessages)
+	app.Post("/api/attachments", hub.UploadAttachment)
+	app.Get("/api/attachments/:id", hub.ServeAttachment)
+	app.Get("/api/attachments/:id/thumbnails/:size", hub.ServeThumbnail)
 
 	app.Use("/ws/chat", hub.Upgrade)
 
@@ -50,5 +121,12 @@ func main() {
 
 	go hub.Run()
 
-	log.Fatal(app.Listen(*addr))
+	// log.Fatal skips deferred calls, so the relay socket and the storage are
+	// closed before
+	err := app.Listen(*addr)
+	if relay != nil {
+		relay.Close() // removes the socket file
+	}
+	hub.Close()
+	log.Fatal(err)
 }
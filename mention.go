@@ -0,0 +1,134 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MaxMentions bounds the distinct names looked up for a single message.
+const MaxMentions = 20
+
+// mentionPattern matches @username at the start of the text or after a
+// character that can not be part of a name, so email addresses are left
+// alone. Dots only count inside a name, not at the end of a sentence.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_-]+(?:\.[\p{L}\p{N}_-]+)*)`)
+
+// Mention is a @username in the text of a message resolved to a user. Offset
+// and Length count UTF-16 code units, as the strings of the client do.
+type Mention struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+}
+
+// mentions resolves the @usernames in text against the user store. Unknown
+// and ambiguous names stay plain text.
+func (h *Hub) mentions(text string) []Mention {
+	var mentions []Mention
+	resolved := map[string]User{} // lowercase name -> user, zero if unknown
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(text, -1) {
+		at, end := match[2]-1, match[3]
+		name := strings.ToLower(text[match[2]:end])
+
+		user, seen := resolved[name]
+		if !seen {
+			if len(resolved) == MaxMentions {
+				break
+			}
+			user, _ = h.user.FindUser(name)
+			resolved[name] = user
+		}
+		if user.ID == "" {
+			continue
+		}
+
+		mentions = append(mentions, Mention{
+			UserID:   user.ID,
+			Username: user.Username,
+			Offset:   utf16Len(text[:at]),
+			Length:   utf16Len(text[at:end]),
+		})
+	}
+	return mentions
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2 // surrogate pair
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// notify_mentioned sends a message to the users it mentions that are
+// connected here, whatever room they are looking at. Authors are not told
+// about their own mentions.
+func (h *Hub) notify_mentioned(message *Message) {
+	notified := map[string]bool{message.UserID: true}
+	for _, mention := range message.Mentions {
+		if notified[mention.UserID] {
+			continue
+		}
+		notified[mention.UserID] = true
+
+		c, ok := h.connection.Load(mention.UserID)
+		if !ok {
+			continue // offline, the mention waits for GET_MENTIONS
+		}
+
+		res := Response{
+			Body: map[string]interface{}{
+				"data": message,
+			},
+			Type: MENTIONED,
+		}
+
+		if err := c.WriteJSON(res); err != nil {
+			if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+				h.unregister(c)
+			}
+		}
+	}
+}
+
+func (h *Hub) get_mentions(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Get last n messages mentioning the user, rooms deleted since left out
+	messages := []Message{}
+	for _, message := range h.message.GetMentions(req.ClientID, h.Options.MaxReturnedMessage) {
+		if _, ok := h.room.Room(message.RoomID); !ok {
+			continue
+		}
+		message.User = h.author(message)
+		messages = append(messages, message)
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"data": &messages,
+		},
+		Type: MENTIONS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
@@ -2,39 +2,278 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
 
 type Message struct {
-	ID        string `json:"id"`
-	UserID    string `json:"userId"`
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	// User is the author as it was when the message was sent. Stores keep it
+	// so history stays readable after the author is gone.
 	User      *User  `json:"user"`
 	RoomID    string `json:"roomId"`
 	Message   string `json:"message"`
 	Timestamp int64  `json:"timestamp"`
+	EditedAt  int64  `json:"editedAt,omitempty"`  // in ms, zero if never edited
+	DeletedAt int64  `json:"deletedAt,omitempty"` // in ms, set on tombstones
+	// ParentID is the message this one replies to in a thread. Threads are
+	// one level deep, replies never have replies of their own.
+	ParentID   string `json:"parentId,omitempty"`
+	ReplyCount int    `json:"replyCount,omitempty"`
+	// ReplyTo quotes an earlier message of the same room
+	ReplyTo  *Quote    `json:"replyTo,omitempty"`
+	Mentions []Mention `json:"mentions,omitempty"`
+	// Reactions maps each emoji to the ids of the users who reacted with it
+	Reactions   map[string][]string `json:"reactions,omitempty"`
+	Attachments []Attachment        `json:"attachments,omitempty"`
+}
+
+// MaxExcerptLength bounds, in runes, the text a quote keeps of its original.
+const MaxExcerptLength = 100
+
+// MaxMessageLength bounds, in runes, the text of a message.
+const MaxMessageLength = 4000
+
+var ErrMessageTooLong = fiber.NewError(fiber.StatusRequestEntityTooLarge, "message is too long")
+
+// validateMessage checks the text of a new or edited message. It may only be
+// blank if files go with it.
+func validateMessage(text string, attachments int) error {
+	if strings.TrimSpace(text) == "" && attachments == 0 {
+		return fiber.ErrBadRequest
+	}
+	if utf8.RuneCountInString(text) > MaxMessageLength {
+		return ErrMessageTooLong
+	}
+	return nil
+}
+
+// Quote is a snapshot of a message taken when a reply quotes it, so the reply
+// reads the same after the original is edited or trimmed away.
+type Quote struct {
+	ID        string `json:"id"`
+	User      *User  `json:"user"`
+	Excerpt   string `json:"excerpt"`
+	Timestamp int64  `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"` // the original is deleted, excerpt dropped
+}
+
+// quote returns a snapshot of the message written by author.
+func (m Message) quote(author *User) *Quote {
+	excerpt := []rune(m.Message)
+	if len(excerpt) > MaxExcerptLength {
+		excerpt = append(excerpt[:MaxExcerptLength], '…')
+	}
+	return &Quote{
+		ID:        m.ID,
+		User:      author,
+		Excerpt:   string(excerpt),
+		Timestamp: m.Timestamp,
+	}
+}
+
+// redacted returns the quote of a deleted message. Quotes are replaced rather
+// than changed in place, the same as reactions.
+func (q Quote) redacted() *Quote {
+	q.Excerpt = ""
+	q.Deleted = true
+	return &q
+}
+
+// MaxReactionLength bounds an emoji in bytes, enough for sequences joined
+// with zero width joiners.
+const MaxReactionLength = 32
+
+// Reaction is a change to the reactions of a message.
+type Reaction struct {
+	RoomID    string   `json:"roomId"`
+	MessageID string   `json:"messageId"`
+	Emoji     string   `json:"emoji"`
+	UserID    string   `json:"userId"`
+	Added     bool     `json:"added"`
+	UserIDs   []string `json:"userIds"` // users reacting with Emoji after the change
+}
+
+// react returns the message with userID's emoji added or removed. Reactions
+// are copied, never changed in place, since stores hand out copies of
+// messages that share them.
+func (m Message) react(emoji string, userID string, add bool) (message Message, changed bool) {
+	if contains(m.Reactions[emoji], userID) == add {
+		return m, false
+	}
+
+	reactions := make(map[string][]string, len(m.Reactions)+1)
+	for e, userIDs := range m.Reactions {
+		reactions[e] = userIDs
+	}
+	if add {
+		reactions[emoji] = append(append([]string(nil), m.Reactions[emoji]...), userID)
+	} else {
+		var userIDs []string
+		for _, id := range m.Reactions[emoji] {
+			if id != userID {
+				userIDs = append(userIDs, id)
+			}
+		}
+		if len(userIDs) == 0 {
+			delete(reactions, emoji)
+		} else {
+			reactions[emoji] = userIDs
+		}
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+
+	m.Reactions = reactions
+	return m, true
+}
+
+// tombstone returns what is left of a deleted message. It keeps its place in
+// the room so cursors on its id still work.
+func (m Message) tombstone(deletedAt int64) Message {
+	m.Message = ""
+	m.EditedAt = 0
+	m.DeletedAt = deletedAt
+	m.Reactions = nil
+	m.ReplyTo = nil
+	m.Mentions = nil
+	m.Attachments = nil
+	return m
+}
+
+// mentions reports whether the message mentions userID.
+func (m Message) mentions(userID string) bool {
+	for _, mention := range m.Mentions {
+		if mention.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// revision returns the current text of a message as a revision.
+func (m Message) revision() Revision {
+	written := m.Timestamp
+	if m.EditedAt != 0 {
+		written = m.EditedAt
+	}
+	return Revision{
+		Message:   m.Message,
+		Timestamp: written,
+	}
+}
+
+// Revision is an earlier text of an edited message.
+type Revision struct {
+	Message   string `json:"message"`
+	Timestamp int64  `json:"timestamp"` // when this text was written, in ms
+}
+
+// byTimestamp orders messages by the time they were sent, then by their
+// sequence in the room.
+type byTimestamp struct {
+	messages []Message
+	seqs     []uint64
+}
+
+func (s byTimestamp) Len() int { return len(s.messages) }
+
+func (s byTimestamp) Less(i, j int) bool {
+	if s.messages[i].Timestamp != s.messages[j].Timestamp {
+		return s.messages[i].Timestamp < s.messages[j].Timestamp
+	}
+	return s.seqs[i] < s.seqs[j]
+}
+
+func (s byTimestamp) Swap(i, j int) {
+	s.messages[i], s.messages[j] = s.messages[j], s.messages[i]
+	s.seqs[i], s.seqs[j] = s.seqs[j], s.seqs[i]
 }
 
 type MessageStore interface {
 	Count(roomID string) int
 	Get(roomID string) []Message
+	// GetLastN returns up to n messages of the main timeline, replies left
+	// out, sent before firstMsgID or the newest ones, oldest first.
 	GetLastN(roomID string, n int, firstMsgID ...string) []Message
-	Set(roomID string, messages []Message)
+	// GetBefore returns up to n messages of the main timeline sent before
+	// the message at cursor, oldest first. It returns false if that message
+	// is no longer kept, e.g. trimmed, rather than the newest ones again.
+	GetBefore(roomID string, n int, cursor Cursor) (messages []Message, ok bool)
+	// GetNextN returns up to n messages of the main timeline sent after
+	// lastMsgID, oldest first, none if it is unknown.
+	GetNextN(roomID string, n int, lastMsgID string) []Message
+	// Seek returns the first message of the main timeline sent at or after
+	// timestamp, in ms.
+	Seek(roomID string, timestamp int64) (message Message, ok bool)
+	// GetThread pages the replies to parentID the same way.
+	GetThread(roomID string, parentID string, n int, firstMsgID ...string) []Message
+	// Append stores a message and counts it on its parent if it is a reply.
 	Append(roomID string, message Message)
+	// Trim drops the oldest messages of a room so at most max are kept, and
+	// returns the attachments they had.
+	Trim(roomID string, max int) (attachments []Attachment)
+	Load(roomID string, msgID string) (message Message, ok bool)
+	// Edit replaces the text and mentions of a message and keeps the old
+	// text as a revision. Edits not newer than the last one and edits of
+	// tombstones are ignored, so replaying an edit is harmless.
+	Edit(roomID string, msgID string, text string, mentions []Mention, editedAt int64) (message Message, ok bool)
+	// Revisions returns the earlier texts of a message, oldest first.
+	Revisions(roomID string, msgID string) []Revision
+	// AddReaction and RemoveReaction change the reactions of a message.
+	// Both are idempotent and ignore tombstones.
+	AddReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool)
+	RemoveReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool)
+	// GetMentions returns up to n of the newest messages mentioning userID,
+	// across rooms and oldest first.
+	GetMentions(userID string, n int) []Message
+	// Delete turns a message into a tombstone, drops its revisions and
+	// redacts the quotes of it. Deleting a tombstone again changes nothing.
+	Delete(roomID string, msgID string, deletedAt int64) (message Message, ok bool)
+	// MarkRead moves the read position of userID in a room forward to msgID.
+	// It returns false if the message is unknown or not after the current
+	// position, so replaying a receipt is harmless.
+	MarkRead(roomID string, userID string, msgID string) bool
+	// ReadPositions returns the id of the last message each user read in a
+	// room, by user id.
+	ReadPositions(roomID string) map[string]string
+	// Unread counts the messages of the main timeline others sent to a room
+	// after the read position of userID. A room userID never read has none.
+	Unread(roomID string, userID string) int
+	// Search returns the page of messages matching query, newest first.
+	Search(query SearchQuery) []Message
+}
+
+// messageRef points at a message of a room.
+type messageRef struct {
+	roomID string
+	msgID  string
 }
 
 type InMemoryMessageStore struct {
 	sync.Mutex
-	messages map[string][]Message
+	messages  map[string][]Message
+	revisions map[string][]Revision          // message id -> revisions
+	reads     map[string]map[string]string   // room id -> user id -> message id
+	words     map[string]map[messageRef]bool // search word -> messages with it
 }
 
 var _ MessageStore = (*InMemoryMessageStore)(nil)
 
 func NewInMemoryMessageStore() *InMemoryMessageStore {
 	m := &InMemoryMessageStore{
-		messages: map[string][]Message{},
+		messages:  map[string][]Message{},
+		revisions: map[string][]Revision{},
+		reads:     map[string]map[string]string{},
+		words:     map[string]map[messageRef]bool{},
 	}
 
 	for i := 1; i < 201; i++ {
@@ -59,6 +298,11 @@ func NewInMemoryMessageStore() *InMemoryMessageStore {
 				Timestamp: time.Now().Unix() * 1000,
 			})
 	}
+	for roomID, messages := range m.messages {
+		for _, message := range messages {
+			m.index(roomID, message, false)
+		}
+	}
 	return m
 }
 
@@ -77,59 +321,373 @@ func (m *InMemoryMessageStore) Get(roomID string) []Message {
 }
 
 func (m *InMemoryMessageStore) GetLastN(roomID string, n int, firstMsgID ...string) []Message {
-	var messages []Message
+	return m.lastN(roomID, "", n, firstMsgID...)
+}
+
+func (m *InMemoryMessageStore) GetThread(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	return m.lastN(roomID, parentID, n, firstMsgID...)
+}
+
+// lastN collects the messages replying to parentID, the main timeline if it
+// is empty, walking back from firstMsgID.
+func (m *InMemoryMessageStore) lastN(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	m.Lock()
+	defer m.Unlock()
+
+	end := len(m.messages[roomID])
 	if len(firstMsgID) > 0 {
-		i := m.indexOf(roomID, firstMsgID[0])
-		if i < 0 {
-			s := len(m.messages[roomID]) - n
-			if s < 0 {
-				s = 0
-			}
-			m.Lock()
-			messages = m.messages[roomID][s:]
-			m.Unlock()
-		} else {
-			s := i - n
-			if s < 0 {
-				s = 0
-			}
-			m.Lock()
-			messages = m.messages[roomID][s:i]
-			m.Unlock()
+		if i := m.indexOf(roomID, firstMsgID[0]); i >= 0 {
+			end = i
 		}
-	} else {
-		s := len(m.messages[roomID]) - n
-		if s < 0 {
-			s = 0
+	}
+	return m.collect(roomID, parentID, end, n)
+}
+
+func (m *InMemoryMessageStore) GetBefore(roomID string, n int, cursor Cursor) (messages []Message, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.find(roomID, cursor)
+	if i < 0 {
+		return nil, false
+	}
+	return m.collect(roomID, "", i, n), true
+}
+
+// find returns the index of the message at cursor, -1 if it is not kept.
+// Messages are appended as they arrive, so their timestamps are mostly
+// sorted and a binary search usually finds it. Messages relayed from other
+// processes or sent across a clock step are out of order, so a miss falls
+// back to looking the id up.
+func (m *InMemoryMessageStore) find(roomID string, cursor Cursor) int {
+	all := m.messages[roomID]
+	i := sort.Search(len(all), func(i int) bool {
+		return all[i].Timestamp >= cursor.Timestamp
+	})
+	for ; i < len(all) && all[i].Timestamp == cursor.Timestamp; i++ {
+		if all[i].ID == cursor.MsgID {
+			return i
 		}
-		m.Lock()
-		messages = m.messages[roomID][s:]
-		m.Unlock()
 	}
+	if i := m.indexOf(roomID, cursor.MsgID); i >= 0 && all[i].Timestamp == cursor.Timestamp {
+		return i
+	}
+	return -1
+}
 
+// collect walks back from end, the message at it left out, for up to n
+// messages replying to parentID.
+func (m *InMemoryMessageStore) collect(roomID string, parentID string, end int, n int) []Message {
+	all := m.messages[roomID]
+
+	// Copied so callers do not share the backing array with the store
+	var messages []Message
+	for i := end - 1; i >= 0 && len(messages) < n; i-- {
+		if all[i].ParentID == parentID {
+			messages = append(messages, all[i])
+		}
+	}
+
+	// Messages were collected newest first, callers expect oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
 	return messages
 }
 
-func (m *InMemoryMessageStore) Set(roomID string, messages []Message) {
+func (m *InMemoryMessageStore) GetNextN(roomID string, n int, lastMsgID string) []Message {
 	m.Lock()
-	m.messages[roomID] = messages
-	m.Unlock()
+	defer m.Unlock()
+
+	i := m.indexOf(roomID, lastMsgID)
+	if i < 0 {
+		return nil
+	}
+
+	// Copied so callers do not share the backing array with the store
+	var messages []Message
+	for _, message := range m.messages[roomID][i+1:] {
+		if len(messages) == n {
+			break
+		}
+		if message.ParentID == "" {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (m *InMemoryMessageStore) Seek(roomID string, timestamp int64) (message Message, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, message := range m.messages[roomID] {
+		if message.ParentID == "" && message.Timestamp >= timestamp {
+			return message, true
+		}
+	}
+	return message, false
 }
 
 func (m *InMemoryMessageStore) Append(roomID string, message Message) {
 	m.Lock()
+	// A parent is older than its replies, so trimming never leaves a count
+	// behind
+	if message.ParentID != "" {
+		if i := m.indexOf(roomID, message.ParentID); i >= 0 {
+			m.messages[roomID][i].ReplyCount++
+		}
+	}
 	m.messages[roomID] = append(m.messages[roomID], message)
+	m.index(roomID, message, false)
 	m.Unlock()
 }
 
-func (m *InMemoryMessageStore) indexOf(roomID string, msgID string) int {
+func (m *InMemoryMessageStore) Trim(roomID string, max int) (attachments []Attachment) {
+	m.Lock()
+	if messages := m.messages[roomID]; len(messages) > max {
+		for _, message := range messages[:len(messages)-max] {
+			attachments = append(attachments, message.Attachments...)
+			delete(m.revisions, message.ID)
+			m.index(roomID, message, true)
+		}
+		// Copy so the dropped messages can be garbage collected
+		m.messages[roomID] = append([]Message(nil), messages[len(messages)-max:]...)
+	}
+	m.Unlock()
+	return attachments
+}
+
+func (m *InMemoryMessageStore) Load(roomID string, msgID string) (message Message, ok bool) {
+	m.Lock()
+	if i := m.indexOf(roomID, msgID); i >= 0 {
+		message, ok = m.messages[roomID][i], true
+	}
+	m.Unlock()
+	return message, ok
+}
+
+func (m *InMemoryMessageStore) Edit(roomID string, msgID string, text string, mentions []Mention, editedAt int64) (message Message, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.indexOf(roomID, msgID)
+	if i < 0 {
+		return message, false
+	}
+	message = m.messages[roomID][i]
+	if message.DeletedAt != 0 || editedAt <= message.EditedAt {
+		return message, true
+	}
+
+	m.revisions[msgID] = append(m.revisions[msgID], message.revision())
+	m.index(roomID, message, true)
+
+	message.Message = text
+	message.Mentions = mentions
+	message.EditedAt = editedAt
+	m.messages[roomID][i] = message
+	m.index(roomID, message, false)
+	return message, true
+}
+
+func (m *InMemoryMessageStore) Revisions(roomID string, msgID string) []Revision {
+	m.Lock()
+	revisions := append([]Revision(nil), m.revisions[msgID]...)
+	m.Unlock()
+	return revisions
+}
+
+func (m *InMemoryMessageStore) GetMentions(userID string, n int) []Message {
+	var messages []Message
+	m.Lock()
+	for _, room := range m.messages {
+		for _, message := range room {
+			if message.mentions(userID) {
+				messages = append(messages, message)
+			}
+		}
+	}
+	m.Unlock()
+
+	// Rooms have no order between them, their messages are ordered by time
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Timestamp < messages[j].Timestamp
+	})
+	if len(messages) > n {
+		messages = messages[len(messages)-n:]
+	}
+	return messages
+}
+
+func (m *InMemoryMessageStore) Delete(roomID string, msgID string, deletedAt int64) (message Message, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.indexOf(roomID, msgID)
+	if i < 0 {
+		return message, false
+	}
+	message = m.messages[roomID][i]
+	if message.DeletedAt != 0 {
+		return message, true
+	}
+
+	m.index(roomID, message, true)
+	message = message.tombstone(deletedAt)
+	m.messages[roomID][i] = message
+	delete(m.revisions, msgID)
+
+	for j, reply := range m.messages[roomID] {
+		if reply.ReplyTo != nil && reply.ReplyTo.ID == msgID {
+			m.messages[roomID][j].ReplyTo = reply.ReplyTo.redacted()
+		}
+	}
+	return message, true
+}
+
+func (m *InMemoryMessageStore) AddReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID, true)
+}
+
+func (m *InMemoryMessageStore) RemoveReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID, false)
+}
+
+func (m *InMemoryMessageStore) react(roomID string, msgID string, emoji string, userID string, add bool) (message Message, ok bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.indexOf(roomID, msgID)
+	if i < 0 {
+		return message, false
+	}
+	message = m.messages[roomID][i]
+	if message.DeletedAt != 0 {
+		return message, true
+	}
+
+	message, _ = message.react(emoji, userID, add)
+	m.messages[roomID][i] = message
+	return message, true
+}
+
+func (m *InMemoryMessageStore) MarkRead(roomID string, userID string, msgID string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	i := m.indexOf(roomID, msgID)
+	if i < 0 {
+		return false
+	}
+	if last, ok := m.reads[roomID][userID]; ok && m.indexOf(roomID, last) >= i {
+		return false
+	}
+
+	if m.reads[roomID] == nil {
+		m.reads[roomID] = map[string]string{}
+	}
+	m.reads[roomID][userID] = msgID
+	return true
+}
+
+func (m *InMemoryMessageStore) ReadPositions(roomID string) map[string]string {
+	positions := map[string]string{}
 	m.Lock()
+	for userID, msgID := range m.reads[roomID] {
+		positions[userID] = msgID
+	}
+	m.Unlock()
+	return positions
+}
+
+func (m *InMemoryMessageStore) Unread(roomID string, userID string) int {
+	m.Lock()
+	defer m.Unlock()
+
+	last, ok := m.reads[roomID][userID]
+	if !ok {
+		return 0
+	}
+
+	// A trimmed position was older than every message left
+	count := 0
+	for _, message := range m.messages[roomID][m.indexOf(roomID, last)+1:] {
+		if message.ParentID == "" && message.DeletedAt == 0 && message.UserID != userID {
+			count++
+		}
+	}
+	return count
+}
+
+func (m *InMemoryMessageStore) Search(query SearchQuery) []Message {
+	rooms := map[string]bool{}
+	for _, roomID := range query.RoomIDs {
+		rooms[roomID] = true
+	}
+
+	var messages []Message
+	var positions []uint64 // in their room, to order the ones sent in the same second
+	m.Lock()
+	for ref := range m.candidates(query) {
+		if !rooms[ref.roomID] {
+			continue
+		}
+		i := m.indexOf(ref.roomID, ref.msgID)
+		if i < 0 {
+			continue
+		}
+		if message := m.messages[ref.roomID][i]; query.matches(message) {
+			messages = append(messages, message)
+			positions = append(positions, uint64(i))
+		}
+	}
+	m.Unlock()
+
+	sort.Sort(sort.Reverse(byTimestamp{messages, positions}))
+	return query.page(messages)
+}
+
+// candidates returns the messages with the rarest word of query, the only
+// ones that may match. Must be called with the lock held.
+func (m *InMemoryMessageStore) candidates(query SearchQuery) map[messageRef]bool {
+	var rarest map[messageRef]bool
+	for i, phrase := range query.Phrases {
+		for j, word := range phrase {
+			refs := m.words[word]
+			if i == 0 && j == 0 || len(refs) < len(rarest) {
+				rarest = refs
+			}
+		}
+	}
+	return rarest
+}
+
+// index adds message under each of its search words, or takes it out if
+// remove is set. Must be called with the lock held.
+func (m *InMemoryMessageStore) index(roomID string, message Message, remove bool) {
+	ref := messageRef{roomID, message.ID}
+	for _, word := range searchWords(message.Message) {
+		if remove {
+			delete(m.words[word], ref)
+			if len(m.words[word]) == 0 {
+				delete(m.words, word)
+			}
+			continue
+		}
+		if m.words[word] == nil {
+			m.words[word] = map[messageRef]bool{}
+		}
+		m.words[word][ref] = true
+	}
+}
+
+// indexOf must be called with the lock held.
+func (m *InMemoryMessageStore) indexOf(roomID string, msgID string) int {
 	for i, msg := range m.messages[roomID] {
 		if msg.ID == msgID {
-			m.Unlock()
 			return i
 		}
 	}
-	m.Unlock()
 	return -1 //not found.
 }
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltMaxMentions bounds the mentions indexed per user, the oldest go
+	// first.
+	boltMaxMentions = 200
+	// boltMaxWordLength bounds the search words indexed, longer ones can not
+	// be searched for.
+	boltMaxWordLength = 255
+)
+
+// boltMention points at a message mentioning a user.
+type boltMention struct {
+	RoomID    string `json:"roomId"`
+	MessageID string `json:"messageId"`
+}
+
+// boltRead is the last message a user read in a room. Seq outlives the
+// message, so the position still orders the messages left once it is trimmed.
+type boltRead struct {
+	MessageID string `json:"messageId"`
+	Seq       uint64 `json:"seq"`
+}
+
+// BoltMessageStore keeps one bucket per room keyed by an increasing sequence,
+// plus a per room index from message id to sequence for cursors and a per
+// user index of the messages mentioning them.
+type BoltMessageStore struct {
+	db *bolt.DB
+}
+
+var _ MessageStore = (*BoltMessageStore)(nil)
+
+func (m *BoltMessageStore) Count(roomID string) int {
+	var count int
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID)); b != nil {
+			count = boltCount(b)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return count
+}
+
+func (m *BoltMessageStore) Get(roomID string) []Message {
+	var messages []Message
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var message Message
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			messages = append(messages, message)
+			return nil
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	return messages
+}
+
+func (m *BoltMessageStore) GetLastN(roomID string, n int, firstMsgID ...string) []Message {
+	return m.lastN(roomID, "", n, firstMsgID...)
+}
+
+func (m *BoltMessageStore) GetThread(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	return m.lastN(roomID, parentID, n, firstMsgID...)
+}
+
+// lastN collects the messages replying to parentID, the main timeline if it
+// is empty, walking back from firstMsgID.
+func (m *BoltMessageStore) lastN(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	var messages []Message
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+
+		// Start right before the cursor message, or at the newest one if the
+		// cursor is missing or unknown
+		var k, v []byte
+		if seq := m.seqOf(tx, roomID, firstMsgID...); seq != nil {
+			c.Seek(seq)
+			k, v = c.Prev()
+		} else {
+			k, v = c.Last()
+		}
+
+		var err error
+		messages, err = boltCollect(c, k, v, parentID, n)
+		return err
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	return messages
+}
+
+func (m *BoltMessageStore) GetBefore(roomID string, n int, cursor Cursor) (messages []Message, ok bool) {
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		// The id bucket finds the message, the timestamp must match so a
+		// cursor can not point at a message it was not made from
+		seq := m.seqOf(tx, roomID, cursor.MsgID)
+		if seq == nil {
+			return nil
+		}
+		c := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID)).Cursor()
+
+		var message Message
+		k, v := c.Seek(seq)
+		if err := json.Unmarshal(v, &message); err != nil {
+			return err
+		}
+		if message.Timestamp != cursor.Timestamp {
+			return nil
+		}
+		ok = true
+
+		k, v = c.Prev()
+		var err error
+		messages, err = boltCollect(c, k, v, "", n)
+		return err
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil, false
+	}
+	return messages, ok
+}
+
+// boltCollect walks c back from k for up to n messages replying to parentID,
+// and returns them oldest first.
+func boltCollect(c *bolt.Cursor, k, v []byte, parentID string, n int) ([]Message, error) {
+	var messages []Message
+	for ; k != nil && len(messages) < n; k, v = c.Prev() {
+		var message Message
+		if err := json.Unmarshal(v, &message); err != nil {
+			return nil, err
+		}
+		if message.ParentID == parentID {
+			messages = append(messages, message)
+		}
+	}
+
+	// Messages were collected newest first, callers expect oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (m *BoltMessageStore) GetNextN(roomID string, n int, lastMsgID string) []Message {
+	var messages []Message
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, lastMsgID)
+		if seq == nil {
+			return nil
+		}
+		c := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID)).Cursor()
+
+		c.Seek(seq)
+		for k, v := c.Next(); k != nil && len(messages) < n; k, v = c.Next() {
+			var message Message
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if message.ParentID == "" {
+				messages = append(messages, message)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	return messages
+}
+
+func (m *BoltMessageStore) Seek(roomID string, timestamp int64) (message Message, ok bool) {
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			message = Message{}
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if message.ParentID == "" && message.Timestamp >= timestamp {
+				ok = true
+				return nil
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Message{}, false
+	}
+	if !ok {
+		return Message{}, false
+	}
+	return message, true
+}
+
+func (m *BoltMessageStore) Append(roomID string, message Message) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		ids, err := tx.Bucket(boltMessageIDsBucket).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		// Ignore duplicates so replaying a message is harmless
+		if ids.Get([]byte(message.ID)) != nil {
+			return nil
+		}
+
+		b, err := tx.Bucket(boltMessagesBucket).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := putJSON(b, itob(seq), message); err != nil {
+			return err
+		}
+		if err := boltIndex(tx, roomID, itob(seq), message.Message, false); err != nil {
+			return err
+		}
+		if err := ids.Put([]byte(message.ID), itob(seq)); err != nil {
+			return err
+		}
+		if err := m.index(tx, roomID, message.ID, message.Mentions, nil); err != nil {
+			return err
+		}
+
+		// A parent is older than its replies, so trimming never leaves a
+		// count behind
+		if message.ParentID == "" {
+			return nil
+		}
+		parentSeq := ids.Get([]byte(message.ParentID))
+		if parentSeq == nil {
+			return nil
+		}
+		var parent Message
+		if err := json.Unmarshal(b.Get(parentSeq), &parent); err != nil {
+			return err
+		}
+		parent.ReplyCount++
+		return putJSON(b, parentSeq, parent)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+}
+
+func (m *BoltMessageStore) Trim(roomID string, max int) (attachments []Attachment) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		ids := tx.Bucket(boltMessageIDsBucket).Bucket([]byte(roomID))
+		if b == nil || ids == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for count := boltCount(b); count > max; count-- {
+			k, v := c.First()
+			var message Message
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			attachments = append(attachments, message.Attachments...)
+			if err := ids.Delete([]byte(message.ID)); err != nil {
+				return err
+			}
+			if err := boltIndex(tx, roomID, k, message.Message, true); err != nil {
+				return err
+			}
+			if revisions := tx.Bucket(boltRevisionsBucket).Bucket([]byte(roomID)); revisions != nil {
+				if err := revisions.Delete([]byte(message.ID)); err != nil {
+					return err
+				}
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	return attachments
+}
+
+func (m *BoltMessageStore) Load(roomID string, msgID string) (message Message, ok bool) {
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, msgID)
+		if seq == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID)).Get(seq), &message)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Message{}, false
+	}
+	return message, ok
+}
+
+func (m *BoltMessageStore) Edit(roomID string, msgID string, text string, mentions []Mention, editedAt int64) (message Message, ok bool) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, msgID)
+		if seq == nil {
+			return nil
+		}
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if err := json.Unmarshal(b.Get(seq), &message); err != nil {
+			return err
+		}
+		ok = true
+		if message.DeletedAt != 0 || editedAt <= message.EditedAt {
+			return nil
+		}
+
+		revisions, err := tx.Bucket(boltRevisionsBucket).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+		var history []Revision
+		if data := revisions.Get([]byte(msgID)); data != nil {
+			if err := json.Unmarshal(data, &history); err != nil {
+				return err
+			}
+		}
+		if err := putJSON(revisions, []byte(msgID), append(history, message.revision())); err != nil {
+			return err
+		}
+
+		if err := m.index(tx, roomID, msgID, mentions, message.Mentions); err != nil {
+			return err
+		}
+
+		if err := boltIndex(tx, roomID, seq, message.Message, true); err != nil {
+			return err
+		}
+		if err := boltIndex(tx, roomID, seq, text, false); err != nil {
+			return err
+		}
+
+		message.Message = text
+		message.Mentions = mentions
+		message.EditedAt = editedAt
+		return putJSON(b, seq, message)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Message{}, false
+	}
+	return message, ok
+}
+
+func (m *BoltMessageStore) Revisions(roomID string, msgID string) []Revision {
+	var revisions []Revision
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRevisionsBucket).Bucket([]byte(roomID))
+		if b == nil {
+			return nil
+		}
+		if data := b.Get([]byte(msgID)); data != nil {
+			return json.Unmarshal(data, &revisions)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	return revisions
+}
+
+func (m *BoltMessageStore) Delete(roomID string, msgID string, deletedAt int64) (message Message, ok bool) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, msgID)
+		if seq == nil {
+			return nil
+		}
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if err := json.Unmarshal(b.Get(seq), &message); err != nil {
+			return err
+		}
+		ok = true
+		if message.DeletedAt != 0 {
+			return nil
+		}
+
+		if revisions := tx.Bucket(boltRevisionsBucket).Bucket([]byte(roomID)); revisions != nil {
+			if err := revisions.Delete([]byte(msgID)); err != nil {
+				return err
+			}
+		}
+		if err := boltIndex(tx, roomID, seq, message.Message, true); err != nil {
+			return err
+		}
+		message = message.tombstone(deletedAt)
+		if err := putJSON(b, seq, message); err != nil {
+			return err
+		}
+
+		// Collect the quotes first, the cursor is not to be used across puts
+		replies := map[string]Message{}
+		if err := b.ForEach(func(k, v []byte) error {
+			var reply Message
+			if err := json.Unmarshal(v, &reply); err != nil {
+				return err
+			}
+			if reply.ReplyTo != nil && reply.ReplyTo.ID == msgID {
+				reply.ReplyTo = reply.ReplyTo.redacted()
+				replies[string(k)] = reply
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for k, reply := range replies {
+			if err := putJSON(b, []byte(k), reply); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Message{}, false
+	}
+	return message, ok
+}
+
+func (m *BoltMessageStore) AddReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID, true)
+}
+
+func (m *BoltMessageStore) RemoveReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID, false)
+}
+
+func (m *BoltMessageStore) react(roomID string, msgID string, emoji string, userID string, add bool) (message Message, ok bool) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, msgID)
+		if seq == nil {
+			return nil
+		}
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if err := json.Unmarshal(b.Get(seq), &message); err != nil {
+			return err
+		}
+		ok = true
+		if message.DeletedAt != 0 {
+			return nil
+		}
+
+		var changed bool
+		if message, changed = message.react(emoji, userID, add); !changed {
+			return nil
+		}
+		return putJSON(b, seq, message)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Message{}, false
+	}
+	return message, ok
+}
+
+func (m *BoltMessageStore) GetMentions(userID string, n int) []Message {
+	var messages []Message
+	var seqs []uint64 // of messages, to order the ones sent in the same second
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMentionsBucket).Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+
+		// The index may point at messages trimmed, deleted or edited since,
+		// or twice at a message mentioning the user again after an edit
+		seen := map[string]bool{}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(messages) < n; k, v = c.Prev() {
+			var mention boltMention
+			if err := json.Unmarshal(v, &mention); err != nil {
+				return err
+			}
+			if seen[mention.MessageID] {
+				continue
+			}
+			seen[mention.MessageID] = true
+
+			seq := m.seqOf(tx, mention.RoomID, mention.MessageID)
+			if seq == nil {
+				continue
+			}
+			var message Message
+			if err := json.Unmarshal(tx.Bucket(boltMessagesBucket).Bucket([]byte(mention.RoomID)).Get(seq), &message); err != nil {
+				return err
+			}
+			if message.mentions(userID) {
+				messages = append(messages, message)
+				seqs = append(seqs, binary.BigEndian.Uint64(seq))
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+
+	// The index is in the order users were mentioned, edits included, while
+	// callers expect the order messages were sent in
+	sort.Sort(byTimestamp{messages, seqs})
+	return messages
+}
+
+func (m *BoltMessageStore) MarkRead(roomID string, userID string, msgID string) (moved bool) {
+	if err := m.db.Update(func(tx *bolt.Tx) error {
+		seq := m.seqOf(tx, roomID, msgID)
+		if seq == nil {
+			return nil
+		}
+		b, err := tx.Bucket(boltReadsBucket).CreateBucketIfNotExists([]byte(roomID))
+		if err != nil {
+			return err
+		}
+
+		read := boltRead{MessageID: msgID, Seq: binary.BigEndian.Uint64(seq)}
+		if data := b.Get([]byte(userID)); data != nil {
+			var last boltRead
+			if err := json.Unmarshal(data, &last); err != nil {
+				return err
+			}
+			if last.Seq >= read.Seq {
+				return nil
+			}
+		}
+		moved = true
+		return putJSON(b, []byte(userID), read)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	return moved
+}
+
+func (m *BoltMessageStore) ReadPositions(roomID string) map[string]string {
+	positions := map[string]string{}
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltReadsBucket).Bucket([]byte(roomID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var read boltRead
+			if err := json.Unmarshal(v, &read); err != nil {
+				return err
+			}
+			positions[string(k)] = read.MessageID
+			return nil
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return positions
+}
+
+func (m *BoltMessageStore) Unread(roomID string, userID string) int {
+	var count int
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		reads := tx.Bucket(boltReadsBucket).Bucket([]byte(roomID))
+		b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+		if reads == nil || b == nil {
+			return nil
+		}
+		data := reads.Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		var read boltRead
+		if err := json.Unmarshal(data, &read); err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(itob(read.Seq + 1)); k != nil; k, v = c.Next() {
+			var message Message
+			if err := json.Unmarshal(v, &message); err != nil {
+				return err
+			}
+			if message.ParentID == "" && message.DeletedAt == 0 && message.UserID != userID {
+				count++
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return 0
+	}
+	return count
+}
+
+func (m *BoltMessageStore) Search(query SearchQuery) []Message {
+	rooms := map[string]bool{}
+	for _, roomID := range query.RoomIDs {
+		rooms[roomID] = true
+	}
+
+	var messages []Message
+	var seqs []uint64
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		// Only the messages with the rarest word may match
+		var rarest *bolt.Bucket
+		for _, phrase := range query.Phrases {
+			for _, word := range phrase {
+				if len(word) > boltMaxWordLength {
+					continue
+				}
+				b := tx.Bucket(boltWordsBucket).Bucket([]byte(word))
+				if b == nil {
+					return nil // no message has it
+				}
+				if rarest == nil || b.Stats().KeyN < rarest.Stats().KeyN {
+					rarest = b
+				}
+			}
+		}
+		if rarest == nil {
+			return nil
+		}
+
+		return rarest.ForEach(func(k, _ []byte) error {
+			roomID, seq := string(k[:len(k)-9]), k[len(k)-8:]
+			if !rooms[roomID] {
+				return nil
+			}
+			b := tx.Bucket(boltMessagesBucket).Bucket([]byte(roomID))
+			if b == nil {
+				return nil
+			}
+			var message Message
+			if err := json.Unmarshal(b.Get(seq), &message); err != nil {
+				return err
+			}
+			if query.matches(message) {
+				messages = append(messages, message)
+				seqs = append(seqs, binary.BigEndian.Uint64(seq))
+			}
+			return nil
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+
+	sort.Sort(sort.Reverse(byTimestamp{messages, seqs}))
+	return query.page(messages)
+}
+
+// boltIndex adds the message at seq of a room under each search word of
+// text, or takes it out if remove is set. Keys are the room id, a zero byte
+// and the sequence.
+func boltIndex(tx *bolt.Tx, roomID string, seq []byte, text string, remove bool) error {
+	key := append(append([]byte(roomID), 0), seq...)
+	for _, word := range searchWords(text) {
+		if len(word) > boltMaxWordLength {
+			continue
+		}
+		if remove {
+			if b := tx.Bucket(boltWordsBucket).Bucket([]byte(word)); b != nil {
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		b, err := tx.Bucket(boltWordsBucket).CreateBucketIfNotExists([]byte(word))
+		if err != nil {
+			return err
+		}
+		if err := b.Put(key, []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index adds a message to the mentions of the users it mentions, skipping the
+// ones already mentioned before an edit.
+func (m *BoltMessageStore) index(tx *bolt.Tx, roomID string, msgID string, mentions []Mention, before []Mention) error {
+	done := map[string]bool{}
+	for _, mention := range before {
+		done[mention.UserID] = true
+	}
+
+	for _, mention := range mentions {
+		if done[mention.UserID] {
+			continue
+		}
+		done[mention.UserID] = true
+
+		b, err := tx.Bucket(boltMentionsBucket).CreateBucketIfNotExists([]byte(mention.UserID))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := putJSON(b, itob(seq), boltMention{RoomID: roomID, MessageID: msgID}); err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for count := boltCount(b); count > boltMaxMentions; count-- {
+			c.First()
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// boltCount counts the keys of a bucket keyed by NextSequence and only ever
+// trimmed from the front, which are contiguous. Unlike Stats it does not walk
+// every page of the bucket.
+func boltCount(b *bolt.Bucket) int {
+	c := b.Cursor()
+	first, _ := c.First()
+	if first == nil {
+		return 0
+	}
+	last, _ := c.Last()
+	return int(binary.BigEndian.Uint64(last)-binary.BigEndian.Uint64(first)) + 1
+}
+
+func (m *BoltMessageStore) seqOf(tx *bolt.Tx, roomID string, msgID ...string) []byte {
+	if len(msgID) == 0 {
+		return nil
+	}
+	ids := tx.Bucket(boltMessageIDsBucket).Bucket([]byte(roomID))
+	if ids == nil {
+		return nil
+	}
+	return ids.Get([]byte(msgID[0]))
+}
@@ -0,0 +1,876 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order and tracked with PRAGMA user_version,
+// so only append to this list.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS messages (
+		seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+		id        TEXT    NOT NULL UNIQUE,
+		room_id   TEXT    NOT NULL,
+		user_id   TEXT    NOT NULL,
+		message   TEXT    NOT NULL,
+		timestamp INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS messages_room_seq ON messages (room_id, seq);`,
+	// Author snapshot, so history keeps its names after users disconnect
+	`ALTER TABLE messages ADD COLUMN username TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN avatar TEXT NOT NULL DEFAULT '';`,
+	// Edits, earlier texts go away with their message
+	`ALTER TABLE messages ADD COLUMN edited_at INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS message_revisions (
+		message_id TEXT    NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		message    TEXT    NOT NULL,
+		timestamp  INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS message_revisions_message ON message_revisions (message_id);`,
+	// Tombstones of deleted messages
+	`ALTER TABLE messages ADD COLUMN deleted_at INTEGER NOT NULL DEFAULT 0;`,
+	// Reactions, one row per user and emoji
+	`CREATE TABLE IF NOT EXISTS message_reactions (
+		message_id TEXT NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		emoji      TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		PRIMARY KEY (message_id, emoji, user_id)
+	);`,
+	// Threads
+	`ALTER TABLE messages ADD COLUMN parent_id TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS messages_room_parent_seq ON messages (room_id, parent_id, seq);`,
+	// Quoted replies, a snapshot of the quoted message
+	`ALTER TABLE messages ADD COLUMN reply_to_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reply_to_user_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reply_to_username TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reply_to_avatar TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reply_to_excerpt TEXT NOT NULL DEFAULT '';
+	ALTER TABLE messages ADD COLUMN reply_to_timestamp INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE messages ADD COLUMN reply_to_deleted INTEGER NOT NULL DEFAULT 0;`,
+	// Mentions, in the order they appear in the text
+	`CREATE TABLE IF NOT EXISTS message_mentions (
+		message_id TEXT    NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		user_id    TEXT    NOT NULL,
+		username   TEXT    NOT NULL,
+		position   INTEGER NOT NULL,
+		length     INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS message_mentions_user ON message_mentions (user_id);
+	CREATE INDEX IF NOT EXISTS message_mentions_message ON message_mentions (message_id);`,
+	// Read positions, with the seq of the message so they still order
+	// messages once it is trimmed
+	`CREATE TABLE IF NOT EXISTS message_reads (
+		room_id    TEXT    NOT NULL,
+		user_id    TEXT    NOT NULL,
+		message_id TEXT    NOT NULL,
+		seq        INTEGER NOT NULL,
+		PRIMARY KEY (room_id, user_id)
+	);`,
+	// Search index over the text of messages, kept in sync by triggers. The
+	// tokenizer splits words like searchWords does.
+	`CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5 (
+		message,
+		content = 'messages',
+		content_rowid = 'seq',
+		tokenize = 'unicode61 remove_diacritics 0'
+	);
+	INSERT INTO messages_fts (messages_fts) VALUES ('rebuild');
+	CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts (rowid, message) VALUES (new.seq, new.message);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.seq, old.message);
+	END;
+	CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF message ON messages BEGIN
+		INSERT INTO messages_fts (messages_fts, rowid, message) VALUES ('delete', old.seq, old.message);
+		INSERT INTO messages_fts (rowid, message) VALUES (new.seq, new.message);
+	END;`,
+	// Attachments, a copy of each in the order they were sent
+	`CREATE TABLE IF NOT EXISTS message_attachments (
+		message_id    TEXT    NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+		attachment_id TEXT    NOT NULL,
+		user_id       TEXT    NOT NULL,
+		room_id       TEXT    NOT NULL,
+		name          TEXT    NOT NULL,
+		mime_type     TEXT    NOT NULL,
+		size          INTEGER NOT NULL,
+		width         INTEGER NOT NULL,
+		height        INTEGER NOT NULL,
+		created_at    INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS message_attachments_message ON message_attachments (message_id);`,
+	// Thumbnails of image attachments, kept as JSON since they are only ever
+	// read along with their attachment
+	`ALTER TABLE message_attachments ADD COLUMN thumbnails TEXT NOT NULL DEFAULT '';
+	ALTER TABLE message_attachments ADD COLUMN placeholder TEXT NOT NULL DEFAULT '';`,
+}
+
+// sqliteBatch bounds the ids bound in a single IN query.
+const sqliteBatch = 500
+
+// sqliteQueryer is what *sql.DB and *sql.Tx have in common for reads.
+type sqliteQueryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sqliteExecer is what *sql.DB and *sql.Tx have in common for writes.
+type sqliteExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// messageColumns are the columns scanMessage expects, in order. Reply counts
+// are computed rather than stored, so trimming can not leave them stale.
+const messageColumns = `id, user_id, room_id, message, timestamp, username, avatar, edited_at, deleted_at, parent_id,
+	(SELECT COUNT(*) FROM messages r WHERE r.room_id = messages.room_id AND r.parent_id = messages.id),
+	reply_to_id, reply_to_user_id, reply_to_username, reply_to_avatar, reply_to_excerpt, reply_to_timestamp, reply_to_deleted`
+
+type SQLiteMessageStore struct {
+	db *sql.DB
+}
+
+var _ MessageStore = (*SQLiteMessageStore)(nil)
+
+func NewSQLiteMessageStore(path string) (*SQLiteMessageStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection keeps the pragmas below in effect and serializes
+	// writers inside this process; busy_timeout covers the prefork children.
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA foreign_keys = ON",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	m := &SQLiteMessageStore{db: db}
+	if err := m.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *SQLiteMessageStore) migrate() error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			return err
+		}
+	}
+	// PRAGMA does not accept bound parameters
+	if _, err := tx.Exec("PRAGMA user_version = " + strconv.Itoa(version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *SQLiteMessageStore) Close() error {
+	return m.db.Close()
+}
+
+func (m *SQLiteMessageStore) Count(roomID string) int {
+	var count int
+	if err := m.db.QueryRow("SELECT COUNT(*) FROM messages WHERE room_id = ?", roomID).Scan(&count); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return count
+}
+
+func (m *SQLiteMessageStore) Get(roomID string) []Message {
+	return m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? ORDER BY seq`, roomID)
+}
+
+func (m *SQLiteMessageStore) GetLastN(roomID string, n int, firstMsgID ...string) []Message {
+	return m.lastN(roomID, "", n, firstMsgID...)
+}
+
+func (m *SQLiteMessageStore) GetThread(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	return m.lastN(roomID, parentID, n, firstMsgID...)
+}
+
+// lastN selects the messages replying to parentID, the main timeline if it
+// is empty, sent before firstMsgID.
+func (m *SQLiteMessageStore) lastN(roomID string, parentID string, n int, firstMsgID ...string) []Message {
+	var messages []Message
+	if seq, ok := m.seqOf(roomID, firstMsgID...); ok {
+		messages = m.query(`SELECT `+messageColumns+` FROM messages
+			WHERE room_id = ? AND parent_id = ? AND seq < ? ORDER BY seq DESC LIMIT ?`, roomID, parentID, seq, n)
+	} else {
+		messages = m.query(`SELECT `+messageColumns+` FROM messages
+			WHERE room_id = ? AND parent_id = ? ORDER BY seq DESC LIMIT ?`, roomID, parentID, n)
+	}
+
+	// Rows come newest first, callers expect oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+func (m *SQLiteMessageStore) GetBefore(roomID string, n int, cursor Cursor) (messages []Message, ok bool) {
+	// The unique index on id finds the message, the timestamp must match so
+	// a cursor can not point at a message it was not made from
+	var seq int64
+	err := m.db.QueryRow("SELECT seq FROM messages WHERE room_id = ? AND id = ? AND timestamp = ?",
+		roomID, cursor.MsgID, cursor.Timestamp).Scan(&seq)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%#v\n", err)
+		}
+		return nil, false
+	}
+
+	messages = m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND parent_id = '' AND seq < ? ORDER BY seq DESC LIMIT ?`, roomID, seq, n)
+
+	// Rows come newest first, callers expect oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, true
+}
+
+func (m *SQLiteMessageStore) GetNextN(roomID string, n int, lastMsgID string) []Message {
+	seq, ok := m.seqOf(roomID, lastMsgID)
+	if !ok {
+		return nil
+	}
+	return m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND parent_id = '' AND seq > ? ORDER BY seq LIMIT ?`, roomID, seq, n)
+}
+
+func (m *SQLiteMessageStore) Seek(roomID string, timestamp int64) (message Message, ok bool) {
+	messages := m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND parent_id = '' AND timestamp >= ? ORDER BY seq LIMIT 1`, roomID, timestamp)
+	if len(messages) == 0 {
+		return message, false
+	}
+	return messages[0], true
+}
+
+func (m *SQLiteMessageStore) Append(roomID string, message Message) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Ignore duplicates so replaying a message is harmless
+	var author User
+	if message.User != nil {
+		author = *message.User
+	}
+	var quote Quote
+	var quoted User
+	if message.ReplyTo != nil {
+		quote = *message.ReplyTo
+		if quote.User != nil {
+			quoted = *quote.User
+		}
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO messages (id, user_id, room_id, message, timestamp, username, avatar, parent_id,
+			reply_to_id, reply_to_user_id, reply_to_username, reply_to_avatar, reply_to_excerpt, reply_to_timestamp, reply_to_deleted)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		message.ID, message.UserID, roomID, message.Message, message.Timestamp, author.Username, author.Avatar, message.ParentID,
+		quote.ID, quoted.ID, quoted.Username, quoted.Avatar, quote.Excerpt, quote.Timestamp, quote.Deleted)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return // a duplicate
+	}
+	if err := insertMentions(tx, message.ID, message.Mentions); err != nil {
+		log.Printf("%#v\n", err)
+		return
+	}
+	if err := insertAttachments(tx, message.ID, message.Attachments); err != nil {
+		log.Printf("%#v\n", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%#v\n", err)
+	}
+}
+
+func (m *SQLiteMessageStore) Trim(roomID string, max int) (attachments []Attachment) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	// Everything at or below the seq of the (max+1)th newest message goes
+	const trimmed = `room_id = ? AND seq <= (
+			SELECT seq FROM messages WHERE room_id = ? ORDER BY seq DESC LIMIT 1 OFFSET ?
+		)`
+
+	// Only the ids are needed to find their attachments
+	rows, err := tx.Query(`SELECT id FROM messages WHERE `+trimmed, roomID, roomID, max)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	var messages []Message
+	for rows.Next() {
+		var message Message
+		if err := rows.Scan(&message.ID); err != nil {
+			rows.Close()
+			log.Printf("%#v\n", err)
+			return nil
+		}
+		messages = append(messages, message)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := loadAttachments(tx, messages); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+
+	// Their reactions, mentions and attachments cascade
+	if _, err := tx.Exec(`DELETE FROM messages WHERE `+trimmed, roomID, roomID, max); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	for _, message := range messages {
+		attachments = append(attachments, message.Attachments...)
+	}
+	return attachments
+}
+
+func (m *SQLiteMessageStore) Load(roomID string, msgID string) (message Message, ok bool) {
+	messages := m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND id = ?`, roomID, msgID)
+	if len(messages) == 0 {
+		return message, false
+	}
+	return messages[0], true
+}
+
+func (m *SQLiteMessageStore) Edit(roomID string, msgID string, text string, mentions []Mention, editedAt int64) (message Message, ok bool) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	defer tx.Rollback()
+
+	message, err = scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND id = ?`, roomID, msgID))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%#v\n", err)
+		}
+		return message, false
+	}
+	if message.DeletedAt != 0 || editedAt <= message.EditedAt {
+		return message, true
+	}
+
+	old := message.revision()
+	if _, err := tx.Exec("INSERT INTO message_revisions (message_id, message, timestamp) VALUES (?, ?, ?)",
+		msgID, old.Message, old.Timestamp); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("UPDATE messages SET message = ?, edited_at = ? WHERE id = ?", text, editedAt, msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("DELETE FROM message_mentions WHERE message_id = ?", msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if err := insertMentions(tx, msgID, mentions); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+
+	message.Message = text
+	message.EditedAt = editedAt
+	messages := []Message{message}
+	if err := loadRelated(m.db, messages); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return messages[0], true
+}
+
+func (m *SQLiteMessageStore) Revisions(roomID string, msgID string) []Revision {
+	rows, err := m.db.Query(`SELECT r.message, r.timestamp FROM message_revisions r
+		JOIN messages m ON m.id = r.message_id
+		WHERE m.room_id = ? AND r.message_id = ? ORDER BY r.rowid`, roomID, msgID)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var revision Revision
+		if err := rows.Scan(&revision.Message, &revision.Timestamp); err != nil {
+			log.Printf("%#v\n", err)
+			return nil
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return revisions
+}
+
+func (m *SQLiteMessageStore) Delete(roomID string, msgID string, deletedAt int64) (message Message, ok bool) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	defer tx.Rollback()
+
+	message, err = scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND id = ?`, roomID, msgID))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%#v\n", err)
+		}
+		return message, false
+	}
+	if message.DeletedAt != 0 {
+		return message, true
+	}
+
+	message = message.tombstone(deletedAt)
+	if _, err := tx.Exec(`UPDATE messages SET message = '', edited_at = 0, deleted_at = ?, reply_to_id = '' WHERE id = ?`,
+		deletedAt, msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec(`UPDATE messages SET reply_to_excerpt = '', reply_to_deleted = 1
+		WHERE room_id = ? AND reply_to_id = ?`, roomID, msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("DELETE FROM message_revisions WHERE message_id = ?", msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("DELETE FROM message_reactions WHERE message_id = ?", msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("DELETE FROM message_mentions WHERE message_id = ?", msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if _, err := tx.Exec("DELETE FROM message_attachments WHERE message_id = ?", msgID); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	return message, true
+}
+
+func (m *SQLiteMessageStore) AddReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID,
+		"INSERT OR IGNORE INTO message_reactions (message_id, emoji, user_id) VALUES (?, ?, ?)")
+}
+
+func (m *SQLiteMessageStore) RemoveReaction(roomID string, msgID string, emoji string, userID string) (message Message, ok bool) {
+	return m.react(roomID, msgID, emoji, userID,
+		"DELETE FROM message_reactions WHERE message_id = ? AND emoji = ? AND user_id = ?")
+}
+
+// react runs stmt, which adds or removes a reaction, and returns the message
+// with its reactions afterwards.
+func (m *SQLiteMessageStore) react(roomID string, msgID string, emoji string, userID string, stmt string) (message Message, ok bool) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	defer tx.Rollback()
+
+	message, err = scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages
+		WHERE room_id = ? AND id = ?`, roomID, msgID))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%#v\n", err)
+		}
+		return message, false
+	}
+
+	if message.DeletedAt == 0 {
+		if _, err := tx.Exec(stmt, msgID, emoji, userID); err != nil {
+			log.Printf("%#v\n", err)
+			return message, false
+		}
+	}
+	messages := []Message{message}
+	if err := loadRelated(tx, messages); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%#v\n", err)
+		return message, false
+	}
+	return messages[0], true
+}
+
+func (m *SQLiteMessageStore) GetMentions(userID string, n int) []Message {
+	messages := m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE deleted_at = 0 AND id IN (SELECT message_id FROM message_mentions WHERE user_id = ?)
+		ORDER BY seq DESC LIMIT ?`, userID, n)
+
+	// Rows come newest first, callers expect oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+func (m *SQLiteMessageStore) MarkRead(roomID string, userID string, msgID string) bool {
+	res, err := m.db.Exec(`INSERT INTO message_reads (room_id, user_id, message_id, seq)
+		SELECT room_id, ?, id, seq FROM messages WHERE room_id = ? AND id = ?
+		ON CONFLICT (room_id, user_id) DO UPDATE SET message_id = excluded.message_id, seq = excluded.seq
+		WHERE excluded.seq > message_reads.seq`, userID, roomID, msgID)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	return n > 0
+}
+
+func (m *SQLiteMessageStore) ReadPositions(roomID string) map[string]string {
+	positions := map[string]string{}
+	rows, err := m.db.Query("SELECT user_id, message_id FROM message_reads WHERE room_id = ?", roomID)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return positions
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, msgID string
+		if err := rows.Scan(&userID, &msgID); err != nil {
+			log.Printf("%#v\n", err)
+			return positions
+		}
+		positions[userID] = msgID
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return positions
+}
+
+func (m *SQLiteMessageStore) Unread(roomID string, userID string) int {
+	var count int
+	if err := m.db.QueryRow(`SELECT COUNT(*) FROM messages
+		JOIN message_reads r ON r.room_id = messages.room_id AND r.user_id = ?
+		WHERE messages.room_id = ? AND messages.seq > r.seq AND parent_id = '' AND deleted_at = 0 AND messages.user_id <> ?`,
+		userID, roomID, userID).Scan(&count); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return count
+}
+
+func (m *SQLiteMessageStore) Search(query SearchQuery) []Message {
+	if len(query.RoomIDs) == 0 {
+		return nil
+	}
+
+	where := []string{
+		"seq IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)",
+		"room_id IN (?" + strings.Repeat(", ?", len(query.RoomIDs)-1) + ")",
+		"deleted_at = 0",
+	}
+	args := []interface{}{query.fts()}
+	for _, roomID := range query.RoomIDs {
+		args = append(args, roomID)
+	}
+	if query.UserID != "" {
+		where = append(where, "user_id = ?")
+		args = append(args, query.UserID)
+	}
+	if query.Since != 0 {
+		where = append(where, "timestamp >= ?")
+		args = append(args, query.Since)
+	}
+	if query.Until != 0 {
+		where = append(where, "timestamp <= ?")
+		args = append(args, query.Until)
+	}
+
+	return m.query(`SELECT `+messageColumns+` FROM messages
+		WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY timestamp DESC, seq DESC LIMIT ? OFFSET ?`, append(args, query.Limit, query.Offset)...)
+}
+
+func (m *SQLiteMessageStore) seqOf(roomID string, msgID ...string) (seq int64, ok bool) {
+	if len(msgID) == 0 {
+		return 0, false
+	}
+	err := m.db.QueryRow("SELECT seq FROM messages WHERE room_id = ? AND id = ?", roomID, msgID[0]).Scan(&seq)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("%#v\n", err)
+		}
+		return 0, false
+	}
+	return seq, true
+}
+
+func (m *SQLiteMessageStore) query(query string, args ...interface{}) []Message {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		log.Printf("%#v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("%#v\n", err)
+			return nil
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	rows.Close()
+
+	if err := loadRelated(m.db, messages); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	return messages
+}
+
+// insertMentions stores the mentions of a message in their order.
+func insertMentions(e sqliteExecer, msgID string, mentions []Mention) error {
+	for _, mention := range mentions {
+		if _, err := e.Exec(`INSERT INTO message_mentions (message_id, user_id, username, position, length)
+			VALUES (?, ?, ?, ?, ?)`, msgID, mention.UserID, mention.Username, mention.Offset, mention.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertAttachments stores the attachments of a message in their order.
+func insertAttachments(e sqliteExecer, msgID string, attachments []Attachment) error {
+	for _, a := range attachments {
+		var thumbnails []byte
+		if len(a.Thumbnails) > 0 {
+			var err error
+			if thumbnails, err = json.Marshal(a.Thumbnails); err != nil {
+				return err
+			}
+		}
+		if _, err := e.Exec(`INSERT INTO message_attachments (message_id, attachment_id, user_id, room_id, name, mime_type,
+				size, width, height, created_at, thumbnails, placeholder)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			msgID, a.ID, a.UserID, a.RoomID, a.Name, a.MimeType, a.Size, a.Width, a.Height, a.CreatedAt,
+			string(thumbnails), a.Placeholder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRelated fills in what messages keep in tables of their own.
+func loadRelated(q sqliteQueryer, messages []Message) error {
+	if err := loadReactions(q, messages); err != nil {
+		return err
+	}
+	if err := loadMentions(q, messages); err != nil {
+		return err
+	}
+	return loadAttachments(q, messages)
+}
+
+// loadAttachments fills in the attachments of messages, in the order they
+// were sent.
+func loadAttachments(q sqliteQueryer, messages []Message) error {
+	index := messageIndex(messages)
+	return inBatches(messages, func(in string, ids []interface{}) error {
+		rows, err := q.Query(`SELECT message_id, attachment_id, user_id, room_id, name, mime_type, size, width, height, created_at,
+				thumbnails, placeholder
+			FROM message_attachments WHERE message_id IN `+in+` ORDER BY rowid`, ids...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var msgID, thumbnails string
+			var a Attachment
+			if err := rows.Scan(&msgID, &a.ID, &a.UserID, &a.RoomID, &a.Name, &a.MimeType,
+				&a.Size, &a.Width, &a.Height, &a.CreatedAt, &thumbnails, &a.Placeholder); err != nil {
+				return err
+			}
+			if thumbnails != "" {
+				if err := json.Unmarshal([]byte(thumbnails), &a.Thumbnails); err != nil {
+					return err
+				}
+			}
+			message := &messages[index[msgID]]
+			message.Attachments = append(message.Attachments, a)
+		}
+		return rows.Err()
+	})
+}
+
+// loadMentions fills in the mentions of messages, in the order they appear.
+func loadMentions(q sqliteQueryer, messages []Message) error {
+	index := messageIndex(messages)
+	return inBatches(messages, func(in string, ids []interface{}) error {
+		rows, err := q.Query(`SELECT message_id, user_id, username, position, length FROM message_mentions
+			WHERE message_id IN `+in+` ORDER BY rowid`, ids...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var msgID string
+			var mention Mention
+			if err := rows.Scan(&msgID, &mention.UserID, &mention.Username, &mention.Offset, &mention.Length); err != nil {
+				return err
+			}
+			message := &messages[index[msgID]]
+			message.Mentions = append(message.Mentions, mention)
+		}
+		return rows.Err()
+	})
+}
+
+// loadReactions fills in the reactions of messages, users in the order they
+// reacted.
+func loadReactions(q sqliteQueryer, messages []Message) error {
+	index := messageIndex(messages)
+	return inBatches(messages, func(in string, ids []interface{}) error {
+		rows, err := q.Query(`SELECT message_id, emoji, user_id FROM message_reactions
+			WHERE message_id IN `+in+` ORDER BY rowid`, ids...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var msgID, emoji, userID string
+			if err := rows.Scan(&msgID, &emoji, &userID); err != nil {
+				return err
+			}
+			message := &messages[index[msgID]]
+			if message.Reactions == nil {
+				message.Reactions = map[string][]string{}
+			}
+			message.Reactions[emoji] = append(message.Reactions[emoji], userID)
+		}
+		return rows.Err()
+	})
+}
+
+// messageIndex maps the ids of messages to their positions.
+func messageIndex(messages []Message) map[string]int {
+	index := make(map[string]int, len(messages))
+	for i := range messages {
+		index[messages[i].ID] = i
+	}
+	return index
+}
+
+// inBatches calls f with the ids of messages, at most sqliteBatch at a time,
+// and an IN list of placeholders for them.
+func inBatches(messages []Message, f func(in string, ids []interface{}) error) error {
+	for start := 0; start < len(messages); start += sqliteBatch {
+		end := start + sqliteBatch
+		if end > len(messages) {
+			end = len(messages)
+		}
+		ids := make([]interface{}, 0, end-start)
+		for _, message := range messages[start:end] {
+			ids = append(ids, message.ID)
+		}
+		if err := f("(?"+strings.Repeat(", ?", len(ids)-1)+")", ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanMessage(row interface {
+	Scan(dest ...interface{}) error
+}) (message Message, err error) {
+	var author, quoted User
+	var quote Quote
+	if err = row.Scan(&message.ID, &message.UserID, &message.RoomID, &message.Message, &message.Timestamp,
+		&author.Username, &author.Avatar, &message.EditedAt, &message.DeletedAt,
+		&message.ParentID, &message.ReplyCount,
+		&quote.ID, &quoted.ID, &quoted.Username, &quoted.Avatar, &quote.Excerpt, &quote.Timestamp, &quote.Deleted); err != nil {
+		return Message{}, err
+	}
+	if author.Username != "" {
+		author.ID = message.UserID
+		message.User = &author
+	}
+	if quote.ID != "" {
+		quote.User = &quoted
+		message.ReplyTo = &quote
+	}
+	return message, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// presenceSweepInterval is how often idle users are set away.
+const presenceSweepInterval = time.Second
+
+type Presence int
+
+const (
+	Online Presence = iota
+	Away
+	DoNotDisturb
+	Offline
+)
+
+func (p Presence) String() string {
+	return []string{
+		"Online",
+		"Away",
+		"DoNotDisturb",
+		"Offline",
+	}[p]
+}
+
+// PresenceChange is a presence a user got by itself, by going idle or being
+// active again.
+type PresenceChange struct {
+	UserID     string
+	Presence   Presence
+	LastActive time.Time
+}
+
+// PresenceStore tracks the activity of connected users, so the ones who
+// chose to be online go away while idle.
+type PresenceStore interface {
+	// Choose records the presence userID picked. Only Online changes by
+	// itself.
+	Choose(userID string, presence Presence, now time.Time)
+	// Touch records activity of userID.
+	Touch(userID string, now time.Time)
+	// Forget drops a disconnected user and returns when it was last active.
+	Forget(userID string) (lastActive time.Time, ok bool)
+	// Sweep sets the users idle for at least idle away and the ones active
+	// again since online, and returns them.
+	Sweep(now time.Time, idle time.Duration) []PresenceChange
+}
+
+type presenceState struct {
+	chosen Presence
+	idle   bool // away by itself
+	active time.Time
+}
+
+type InMemoryPresenceStore struct {
+	sync.Mutex
+	states map[string]presenceState
+}
+
+var _ PresenceStore = (*InMemoryPresenceStore)(nil)
+
+func NewInMemoryPresenceStore() *InMemoryPresenceStore {
+	return &InMemoryPresenceStore{
+		states: map[string]presenceState{},
+	}
+}
+
+func (s *InMemoryPresenceStore) Choose(userID string, presence Presence, now time.Time) {
+	s.Lock()
+	s.states[userID] = presenceState{
+		chosen: presence,
+		active: now,
+	}
+	s.Unlock()
+}
+
+func (s *InMemoryPresenceStore) Touch(userID string, now time.Time) {
+	s.Lock()
+	if state, ok := s.states[userID]; ok {
+		state.active = now
+		s.states[userID] = state
+	}
+	s.Unlock()
+}
+
+func (s *InMemoryPresenceStore) Forget(userID string) (lastActive time.Time, ok bool) {
+	s.Lock()
+	state, ok := s.states[userID]
+	delete(s.states, userID)
+	s.Unlock()
+	return state.active, ok
+}
+
+func (s *InMemoryPresenceStore) Sweep(now time.Time, idle time.Duration) []PresenceChange {
+	var changes []PresenceChange
+
+	s.Lock()
+	for userID, state := range s.states {
+		if state.chosen != Online {
+			continue
+		}
+		away := idle > 0 && now.Sub(state.active) >= idle
+		if away == state.idle {
+			continue
+		}
+		state.idle = away
+		s.states[userID] = state
+
+		change := PresenceChange{
+			UserID:     userID,
+			Presence:   Online,
+			LastActive: state.active,
+		}
+		if away {
+			change.Presence = Away
+		}
+		changes = append(changes, change)
+	}
+	s.Unlock()
+	return changes
+}
+
+func (h *Hub) set_presence(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read presence from request body
+	tmp, ok := req.Body["presence"].(float64)
+	presence := Presence(tmp)
+	if !ok || float64(presence) != tmp || presence < Online || presence > Offline {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// Load user
+	user, ok := h.user.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	now := time.Now()
+	h.presence.Choose(user.ID, presence, now)
+
+	user.Presence = presence
+	user.LastSeen = now.UnixNano() / int64(time.Millisecond)
+	h.presence_changed(user, h.joined_room_ids(user.ID))
+
+	// Inform user itself here
+	res := Response{
+		Body: map[string]interface{}{
+			"data": &user,
+		},
+		Type: PRESENCE_CHANGED,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// sweep_presence sets idle users away and active ones online again.
+func (h *Hub) sweep_presence(now time.Time) {
+	for _, change := range h.presence.Sweep(now, h.Options.AwayTimeout) {
+		user, ok := h.user.Load(change.UserID)
+		if !ok {
+			continue
+		}
+		user.Presence = change.Presence
+		user.LastSeen = change.LastActive.UnixNano() / int64(time.Millisecond)
+		h.presence_changed(user, h.joined_room_ids(user.ID))
+
+		// The user may be looking at the screen without sending anything
+		if c, ok := h.connection.Load(user.ID); ok {
+			res := Response{
+				Body: map[string]interface{}{
+					"data": &user,
+				},
+				Type: PRESENCE_CHANGED,
+			}
+			if err := c.WriteJSON(res); err != nil {
+				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+					h.unregister(c)
+				}
+			}
+		}
+	}
+}
+
+// presence_changed stores the new presence of user and informs the users it
+// shares a room with.
+func (h *Hub) presence_changed(user User, roomIDs []string) {
+	h.user.Store(user.ID, user)
+
+	// Inform other processes
+	h.publish(Event{
+		Type:    EVENT_PRESENCE_CHANGED,
+		RoomIDs: roomIDs,
+		User:    &user,
+	})
+
+	h.broadcast_rooms(roomIDs, user.ID, Response{
+		Body: map[string]interface{}{
+			"data": &user,
+		},
+		Type: PRESENCE_CHANGED,
+	})
+}
@@ -7,6 +7,27 @@ type Request struct {
 	Type     RequestType            `json:"type"`
 }
 
+// optionalString reads an optional field of the body. It is not ok only if
+// the field holds something else than a string.
+func (r *Request) optionalString(key string) (s string, ok bool) {
+	tmp, found := r.Body[key]
+	if !found || tmp == nil {
+		return "", true
+	}
+	s, ok = tmp.(string)
+	return s, ok
+}
+
+// optionalNumber reads an optional number of the body like optionalString.
+func (r *Request) optionalNumber(key string) (n float64, ok bool) {
+	tmp, found := r.Body[key]
+	if !found || tmp == nil {
+		return 0, true
+	}
+	n, ok = tmp.(float64)
+	return n, ok
+}
+
 type RequestType int
 
 const (
@@ -16,6 +37,27 @@ const (
 	LEFT_CHAT
 	SEND_MESSAGE
 	GET_OLD_MESSAGES
+	CREATE_ROOM
+	RENAME_ROOM
+	DELETE_ROOM
+	OPEN_DM
+	SEND_DIRECT_MESSAGE
+	GET_DIRECT_ROOMS
+	FOCUS_ROOM
+	EDIT_MESSAGE
+	GET_MESSAGE_REVISIONS
+	DELETE_MESSAGE
+	ADD_REACTION
+	REMOVE_REACTION
+	GET_THREAD
+	GET_MENTIONS
+	TYPING_START
+	TYPING_STOP
+	MARK_READ
+	SET_PRESENCE
+	SEARCH_MESSAGES
+	GET_MESSAGES_AROUND
+	GET_NEWER_MESSAGES
 )
 
 func (t RequestType) String() string {
@@ -26,5 +68,26 @@ func (t RequestType) String() string {
 		"LEFT_CHAT",
 		"SEND_MESSAGE",
 		"GET_OLD_MESSAGES",
+		"CREATE_ROOM",
+		"RENAME_ROOM",
+		"DELETE_ROOM",
+		"OPEN_DM",
+		"SEND_DIRECT_MESSAGE",
+		"GET_DIRECT_ROOMS",
+		"FOCUS_ROOM",
+		"EDIT_MESSAGE",
+		"GET_MESSAGE_REVISIONS",
+		"DELETE_MESSAGE",
+		"ADD_REACTION",
+		"REMOVE_REACTION",
+		"GET_THREAD",
+		"GET_MENTIONS",
+		"TYPING_START",
+		"TYPING_STOP",
+		"MARK_READ",
+		"SET_PRESENCE",
+		"SEARCH_MESSAGES",
+		"GET_MESSAGES_AROUND",
+		"GET_NEWER_MESSAGES",
 	}[t]
 }
@@ -21,6 +21,26 @@ const (
 	ME_MESSAGE_SEND
 	OTHER_MESSAGE_SEND
 	OLD_MESSAGES
+	ROOMS_CHANGED
+	DM_OPENED
+	ME_DIRECT_MESSAGE_SEND
+	OTHER_DIRECT_MESSAGE_SEND
+	DIRECT_ROOMS
+	UNREAD_COUNTS
+	MESSAGE_EDITED
+	MESSAGE_REVISIONS
+	MESSAGE_DELETED
+	REACTION_CHANGED
+	THREAD_REPLY
+	THREAD_MESSAGES
+	MENTIONED
+	MENTIONS
+	USER_TYPING
+	READ_POSITION
+	PRESENCE_CHANGED
+	SEARCH_RESULTS
+	MESSAGES_AROUND
+	NEWER_MESSAGES
 )
 
 func (t ResponseType) String() string {
@@ -37,5 +57,25 @@ func (t ResponseType) String() string {
 		"ME_MESSAGE_SEND",
 		"OTHER_MESSAGE_SEND",
 		"OLD_MESSAGES",
+		"ROOMS_CHANGED",
+		"DM_OPENED",
+		"ME_DIRECT_MESSAGE_SEND",
+		"OTHER_DIRECT_MESSAGE_SEND",
+		"DIRECT_ROOMS",
+		"UNREAD_COUNTS",
+		"MESSAGE_EDITED",
+		"MESSAGE_REVISIONS",
+		"MESSAGE_DELETED",
+		"REACTION_CHANGED",
+		"THREAD_REPLY",
+		"THREAD_MESSAGES",
+		"MENTIONED",
+		"MENTIONS",
+		"USER_TYPING",
+		"READ_POSITION",
+		"PRESENCE_CHANGED",
+		"SEARCH_RESULTS",
+		"MESSAGES_AROUND",
+		"NEWER_MESSAGES",
 	}[t]
 }
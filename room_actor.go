@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+)
+
+// RoomActor owns the joins, leaves and messages of a single room. Each room
+// runs in its own goroutine, so busy rooms do not hold up each other and the
+// hub only has to route requests to them.
+type RoomActor struct {
+	sync.Mutex
+	ID    string
+	hub   *Hub
+	inbox []func()
+	wake  chan struct{}
+	stop  chan struct{}
+}
+
+func NewRoomActor(hub *Hub, roomID string) *RoomActor {
+	return &RoomActor{
+		ID:   roomID,
+		hub:  hub,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+}
+
+// Request queues a request of the room, e.g. JOIN_CHAT or SEND_MESSAGE.
+func (a *RoomActor) Request(req *Request) {
+	a.do(func() {
+		switch req.Type {
+
+		case JOIN_CHAT:
+			a.hub.join_chat(req)
+
+		case LEFT_CHAT:
+			a.hub.leave_chat(req)
+
+		case SEND_MESSAGE:
+			a.hub.send_message(req)
+
+		case GET_OLD_MESSAGES:
+			a.hub.old_messages(req)
+
+		case EDIT_MESSAGE:
+			a.hub.edit_message(req)
+
+		case GET_MESSAGE_REVISIONS:
+			a.hub.message_revisions(req)
+
+		case DELETE_MESSAGE:
+			a.hub.delete_message(req)
+
+		case ADD_REACTION, REMOVE_REACTION:
+			a.hub.react(req)
+
+		case GET_THREAD:
+			a.hub.thread_messages(req)
+
+		case TYPING_START, TYPING_STOP:
+			a.hub.set_typing(req)
+
+		case MARK_READ:
+			a.hub.mark_read(req)
+
+		case GET_MESSAGES_AROUND:
+			a.hub.messages_around(req)
+
+		case GET_NEWER_MESSAGES:
+			a.hub.newer_messages(req)
+		}
+	})
+}
+
+// Event queues an event published by a hub in another process.
+func (a *RoomActor) Event(event Event) {
+	a.do(func() {
+		a.hub.remote_event(event)
+	})
+}
+
+// Disconnect queues the removal of a user who lost connection.
+func (a *RoomActor) Disconnect(user User) {
+	a.do(func() {
+		a.hub.lost_connection(a.ID, user)
+	})
+}
+
+func (a *RoomActor) Run() {
+	for {
+		select {
+		case <-a.wake:
+			a.Lock()
+			inbox := a.inbox
+			a.inbox = nil
+			a.Unlock()
+
+			for _, f := range inbox {
+				f()
+			}
+
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+func (a *RoomActor) Stop() {
+	close(a.stop)
+}
+
+// Close runs f and stops the actor once the work queued so far is done.
+func (a *RoomActor) Close(f func()) {
+	a.do(func() {
+		f()
+		a.Stop()
+	})
+}
+
+// do never blocks, so handlers may queue work for any actor, their own
+// included, without deadlocking.
+func (a *RoomActor) do(f func()) {
+	a.Lock()
+	a.inbox = append(a.inbox, f)
+	a.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default: // already woken up
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+const (
+	benchRooms   = 15 // busy rooms, at most the default topic rooms
+	benchClients = 10 // clients in each of them
+)
+
+// BenchmarkRoomActors sends b.N messages spread over many busy rooms through
+// the hub and their actors, and waits until every other client in the room
+// received them. Compare runs with
+//
+//	$ go test -run - -bench RoomActors -benchmem
+func BenchmarkRoomActors(b *testing.B) {
+	hub, addr := serveHub(b)
+	hub.Options.QueueSize = 4096 // nothing is dropped while clients keep up
+
+	rooms := hub.room.Rooms()
+	if len(rooms) < benchRooms {
+		b.Fatalf("%d rooms, want %d", len(rooms), benchRooms)
+	}
+	rooms = rooms[:benchRooms]
+
+	// Connect and join every client
+	url := fmt.Sprintf("ws://%s/ws/chat", addr)
+	var conns []*fws.Conn
+	var connRooms []string
+	for _, room := range rooms {
+		for i := 0; i < benchClients; i++ {
+			conn, _, err := fws.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			if err := conn.WriteJSON(Request{Type: JOIN_CHAT, Body: map[string]interface{}{"roomId": room.ID}}); err != nil {
+				b.Fatal(err)
+			}
+			if err := until(conn, ME_JOINED_CHAT); err != nil {
+				b.Fatal(err)
+			}
+			conns = append(conns, conn)
+			connRooms = append(connRooms, room.ID)
+		}
+	}
+
+	// Each message is delivered to the other clients of its room, anything
+	// else like the joins of later clients is skipped
+	expected := int64(b.N * (benchClients - 1))
+	var delivered int64
+	done := make(chan struct{})
+	for _, conn := range conns {
+		go func(conn *fws.Conn) {
+			for {
+				var res Response
+				if err := conn.ReadJSON(&res); err != nil {
+					return // closed at the end
+				}
+				if res.Type == OTHER_MESSAGE_SEND && atomic.AddInt64(&delivered, 1) == expected {
+					close(done)
+				}
+			}
+		}(conn)
+	}
+
+	b.ResetTimer()
+	start := time.Now()
+	var sent sync.WaitGroup
+	for i, conn := range conns {
+		n := b.N / len(conns)
+		if i < b.N%len(conns) {
+			n++
+		}
+		sent.Add(1)
+		go func(conn *fws.Conn, roomID string, n int) {
+			defer sent.Done()
+			for j := 0; j < n; j++ {
+				if err := conn.WriteJSON(Request{Type: SEND_MESSAGE, Body: map[string]interface{}{
+					"roomId":  roomID,
+					"message": fmt.Sprintf("bench %d", j),
+				}}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(conn, connRooms[i], n)
+	}
+	sent.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		b.Fatalf("delivered %d of %d messages, %d frames dropped", atomic.LoadInt64(&delivered), expected, atomic.LoadInt64(&hub.stats.Dropped))
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msg/s")
+}
+
+// racingUserStore holds up the first loads of a user until two goroutines
+// wait in them, so two unregisters of one connection overlap if both get
+// that far. It counts the users deleted, once for each unregister.
+type racingUserStore struct {
+	UserStore
+	sync.Mutex
+	userID  string        // whose loads are held up
+	waiting int           // loads of userID so far
+	both    chan struct{} // closed once two loads wait
+	deleted map[string]int
+}
+
+func (s *racingUserStore) race(userID string) {
+	s.Lock()
+	s.userID, s.waiting, s.both = userID, 0, make(chan struct{})
+	s.Unlock()
+}
+
+func (s *racingUserStore) Load(userID string) (User, bool) {
+	s.Lock()
+	both := s.both
+	if userID == s.userID {
+		if s.waiting++; s.waiting == 2 {
+			close(s.both)
+		}
+	}
+	s.Unlock()
+
+	if userID == s.userID {
+		select {
+		case <-both:
+		case <-time.After(200 * time.Millisecond): // the other never came
+		}
+	}
+	return s.UserStore.Load(userID)
+}
+
+func (s *racingUserStore) Delete(userID string) {
+	s.Lock()
+	s.deleted[userID]++
+	s.Unlock()
+	s.UserStore.Delete(userID)
+}
+
+// TestRoomActorsUnregisterOnce lets the actors of two rooms fail to write to
+// the same connection at once. Only one of them may unregister it.
+func TestRoomActorsUnregisterOnce(t *testing.T) {
+	users := &racingUserStore{deleted: map[string]int{}}
+	hub, addr := serveHub(t, func(hub *Hub) {
+		users.UserStore = hub.user
+		hub.user = users
+	})
+
+	rooms := hub.room.Rooms()[:2]
+	conn, _, err := fws.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/chat", addr), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var res struct {
+		Body struct {
+			Data User `json:"data"`
+		} `json:"body"`
+	}
+	if err := conn.ReadJSON(&res); err != nil {
+		t.Fatal(err)
+	}
+	clientID := res.Body.Data.ID
+	for _, room := range rooms {
+		if err := conn.WriteJSON(Request{Type: JOIN_CHAT, Body: map[string]interface{}{"roomId": room.ID}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := until(conn, ME_JOINED_CHAT); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes fail from now on while the client stays connected
+	c, ok := hub.connection.Load(clientID)
+	if !ok {
+		t.Fatal("connection is not stored")
+	}
+	c.Lock()
+	c.close()
+	c.Unlock()
+
+	// Sending the messages around a time loads no user before writing, so
+	// the loads held up are the ones of unregister
+	users.race(clientID)
+	for _, room := range rooms {
+		actor, ok := hub.actor(room.ID)
+		if !ok {
+			t.Fatal("room has no actor")
+		}
+		actor.Request(&Request{
+			ClientID: clientID,
+			Body:     map[string]interface{}{"roomId": room.ID, "timestamp": float64(1)},
+			Type:     GET_MESSAGES_AROUND,
+		})
+	}
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := hub.connection.Load(clientID); !ok {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("connection was not unregistered")
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	users.Lock()
+	deleted := users.deleted[clientID]
+	users.Unlock()
+	if deleted != 1 {
+		t.Fatalf("unregistered %d times", deleted)
+	}
+}
+
+// serveHub starts a hub on a loopback port and returns it with its address.
+// configure may replace its stores before it runs.
+func serveHub(tb testing.TB, configure ...func(hub *Hub)) (*Hub, string) {
+	tb.Helper()
+	hub := NewHub()
+	if err := hub.Defaults(StorageOptions{Driver: MemoryDriver, AttachmentDir: tb.TempDir()}); err != nil {
+		tb.Fatal(err)
+	}
+	for _, f := range configure {
+		f(hub)
+	}
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use("/ws/chat", hub.Upgrade)
+	app.Get("/ws/chat", websocket.New(hub.Handler))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go app.Listener(ln)
+	go hub.Run()
+
+	tb.Cleanup(func() {
+		app.Shutdown()
+		hub.Close()
+	})
+	return hub, ln.Addr().String()
+}
+
+// until reads responses until one of typ arrives.
+func until(conn *fws.Conn, typ ResponseType) error {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		var res Response
+		if err := conn.ReadJSON(&res); err != nil {
+			return err
+		}
+		if res.Type == typ {
+			return nil
+		}
+	}
+}
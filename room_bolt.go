@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltRoomStore persists room metadata. Room membership and the rooms of
+// users are session state and only live in memory, so connections do not
+// leave rows behind.
+type BoltRoomStore struct {
+	sync.Mutex
+	db        *bolt.DB
+	users     map[string][]string
+	userRooms map[string]Room
+}
+
+var _ RoomStore = (*BoltRoomStore)(nil)
+
+func (r *BoltRoomStore) Create(roomID string, roomName string, roomType RoomType) {
+	if roomType == UserRoom {
+		r.Lock()
+		if _, ok := r.userRooms[roomID]; !ok {
+			r.userRooms[roomID] = Room{
+				ID:   roomID,
+				Name: roomName,
+				Type: roomType,
+			}
+		}
+		r.Unlock()
+		return
+	}
+
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRoomsBucket)
+		if b.Get([]byte(roomID)) != nil {
+			return nil
+		}
+		return putJSON(b, []byte(roomID), Room{
+			ID:   roomID,
+			Name: roomName,
+			Type: roomType,
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+}
+
+func (r *BoltRoomStore) Add(room Room) bool {
+	added := false
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRoomsBucket)
+		if b.Get([]byte(room.ID)) != nil {
+			return nil
+		}
+		if taken, err := roomNameTaken(b, room.ID, room.Name); err != nil || taken {
+			return err
+		}
+		room.Users = nil
+		if err := putJSON(b, []byte(room.ID), room); err != nil {
+			return err
+		}
+		added = true
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	return added
+}
+
+func (r *BoltRoomStore) Rename(roomID string, roomName string) bool {
+	renamed := false
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRoomsBucket)
+		data := b.Get([]byte(roomID))
+		if data == nil {
+			return nil
+		}
+		if taken, err := roomNameTaken(b, roomID, roomName); err != nil || taken {
+			return err
+		}
+		var room Room
+		if err := json.Unmarshal(data, &room); err != nil {
+			return err
+		}
+		room.Name = roomName
+		if err := putJSON(b, []byte(roomID), room); err != nil {
+			return err
+		}
+		renamed = true
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	return renamed
+}
+
+func (r *BoltRoomStore) Delete(roomID string) {
+	if err := r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoomsBucket).Delete([]byte(roomID))
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+
+	r.Lock()
+	delete(r.users, roomID)
+	delete(r.userRooms, roomID)
+	r.Unlock()
+}
+
+func roomNameTaken(b *bolt.Bucket, roomID string, roomName string) (taken bool, err error) {
+	err = b.ForEach(func(k, v []byte) error {
+		if string(k) == roomID {
+			return nil
+		}
+		var room Room
+		if err := json.Unmarshal(v, &room); err != nil {
+			return err
+		}
+		if room.Type == TopicRoom && strings.EqualFold(room.Name, roomName) {
+			taken = true
+		}
+		return nil
+	})
+	return taken, err
+}
+
+func (r *BoltRoomStore) Join(roomID string, userID string) bool {
+	if _, ok := r.load(roomID); !ok {
+		return false
+	}
+
+	r.Lock()
+	if !contains(r.users[roomID], userID) {
+		r.users[roomID] = append(r.users[roomID], userID)
+	}
+	r.Unlock()
+	return true
+}
+
+func (r *BoltRoomStore) Leave(roomID string, userID string) {
+	r.Lock()
+	for id, users := range r.users {
+		if roomID != "" && id != roomID {
+			continue
+		}
+		for i, cid := range users {
+			if userID == cid {
+				r.users[id] = append(users[:i:i], users[i+1:]...)
+				break
+			}
+		}
+	}
+	r.Unlock()
+}
+
+func (r *BoltRoomStore) Users(roomID string) []string {
+	r.Lock()
+	users := append([]string{}, r.users[roomID]...)
+	r.Unlock()
+	return users
+}
+
+func (r *BoltRoomStore) Room(roomID string) (room Room, ok bool) {
+	room, ok = r.load(roomID)
+	if ok {
+		room.Users = r.Users(roomID)
+	}
+	return room, ok
+}
+
+func (r *BoltRoomStore) Rooms(includeUserRoom ...bool) []Room {
+	incAll := false
+	if len := len(includeUserRoom); len > 0 && includeUserRoom[0] {
+		incAll = true
+	}
+	var rooms []Room
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoomsBucket).ForEach(func(k, v []byte) error {
+			var room Room
+			if err := json.Unmarshal(v, &room); err != nil {
+				return err
+			}
+			if room.Type != TopicRoom && !incAll {
+				return nil
+			}
+			rooms = append(rooms, room)
+			return nil
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+	if incAll {
+		r.Lock()
+		for _, room := range r.userRooms {
+			rooms = append(rooms, room)
+		}
+		r.Unlock()
+	}
+
+	for i := range rooms {
+		rooms[i].Users = r.Users(rooms[i].ID)
+	}
+	return rooms
+}
+
+func (r *BoltRoomStore) DirectRooms(userID string) []Room {
+	var rooms []Room
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoomsBucket).ForEach(func(k, v []byte) error {
+			var room Room
+			if err := json.Unmarshal(v, &room); err != nil {
+				return err
+			}
+			if room.Type == DirectRoom && contains(room.Members, userID) {
+				rooms = append(rooms, room)
+			}
+			return nil
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+
+	for i := range rooms {
+		rooms[i].Users = r.Users(rooms[i].ID)
+	}
+	return rooms
+}
+
+func (r *BoltRoomStore) JoinedRooms(userID string) []Room {
+	var roomIDs []string
+	r.Lock()
+	for id, users := range r.users {
+		if contains(users, userID) {
+			roomIDs = append(roomIDs, id)
+		}
+	}
+	r.Unlock()
+
+	var rooms []Room
+	for _, id := range roomIDs {
+		if room, ok := r.Room(id); ok {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+func (r *BoltRoomStore) load(roomID string) (room Room, ok bool) {
+	r.Lock()
+	room, ok = r.userRooms[roomID]
+	r.Unlock()
+	if ok {
+		return room, true
+	}
+
+	if err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltRoomsBucket).Get([]byte(roomID))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &room)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Room{}, false
+	}
+	return room, ok
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	MaxSearchLength = 256 // bytes of a query
+	MaxSearchWords  = 16
+)
+
+// SearchQuery selects the messages a search returns, newest first. Deleted
+// messages are never found.
+type SearchQuery struct {
+	Phrases [][]string // words that must follow each other, a single word is a phrase too
+	RoomIDs []string   // rooms searched
+	UserID  string     // author, anyone if empty
+	Since   int64      // oldest timestamp in ms, zero for no limit
+	Until   int64      // newest timestamp in ms, zero for no limit
+	Offset  int
+	Limit   int
+}
+
+// searchWords splits text into the lowercase words it is indexed under, runs
+// of letters and numbers as the unicode61 tokenizer of SQLite sees them.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// parseSearch splits a query into its phrases: the words of each "quoted
+// part" together and every other word alone.
+func parseSearch(text string) [][]string {
+	var phrases [][]string
+	for i, part := range strings.Split(text, `"`) {
+		words := searchWords(part)
+		if i%2 == 0 {
+			for _, word := range words {
+				phrases = append(phrases, []string{word})
+			}
+		} else if len(words) > 0 {
+			phrases = append(phrases, words)
+		}
+	}
+	return phrases
+}
+
+// matches reports whether message passes the filters of q and has its
+// phrases. Room scoping is left to the stores.
+func (q SearchQuery) matches(message Message) bool {
+	if message.DeletedAt != 0 ||
+		q.UserID != "" && message.UserID != q.UserID ||
+		q.Since != 0 && message.Timestamp < q.Since ||
+		q.Until != 0 && message.Timestamp > q.Until {
+		return false
+	}
+
+	words := searchWords(message.Message)
+	for _, phrase := range q.Phrases {
+		if !hasPhrase(words, phrase) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPhrase(words []string, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		j := 0
+		for j < len(phrase) && words[i+j] == phrase[j] {
+			j++
+		}
+		if j == len(phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// fts writes the phrases of q as an FTS5 query. Words have no quotes, so
+// they need no escaping.
+func (q SearchQuery) fts() string {
+	phrases := make([]string, len(q.Phrases))
+	for i, phrase := range q.Phrases {
+		phrases[i] = `"` + strings.Join(phrase, " ") + `"`
+	}
+	return strings.Join(phrases, " ")
+}
+
+// page returns the results of messages, all matches sorted newest first, that
+// q asks for.
+func (q SearchQuery) page(messages []Message) []Message {
+	if q.Offset >= len(messages) {
+		return nil
+	}
+	messages = messages[q.Offset:]
+	if len(messages) > q.Limit {
+		messages = messages[:q.Limit]
+	}
+	return messages
+}
+
+// search runs a query of userID in roomID, or in every room it can see if
+// roomID is empty. It returns a page of results and whether more follow.
+func (h *Hub) search(userID string, text string, roomID string, query SearchQuery) (messages []Message, hasMore bool, err error) {
+	if len(text) > MaxSearchLength {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "query must be at most 256 bytes")
+	}
+	query.Phrases = parseSearch(text)
+	words := 0
+	for _, phrase := range query.Phrases {
+		words += len(phrase)
+	}
+	if words == 0 || words > MaxSearchWords {
+		return nil, false, fiber.NewError(fiber.StatusBadRequest, "query must have 1 to 16 words")
+	}
+	if query.Offset < 0 || query.Since < 0 || query.Until < 0 {
+		return nil, false, fiber.ErrBadRequest
+	}
+
+	// Search the topic rooms and the direct rooms of user, or the one asked
+	// for if user can see it
+	if roomID == "" {
+		for _, room := range h.room.Rooms() {
+			query.RoomIDs = append(query.RoomIDs, room.ID)
+		}
+		for _, room := range h.room.DirectRooms(userID) {
+			query.RoomIDs = append(query.RoomIDs, room.ID)
+		}
+	} else {
+		room, ok := h.room.Room(roomID)
+		if !ok {
+			return nil, false, fiber.ErrNotFound
+		}
+		if room.Type == DirectRoom && !contains(room.Members, userID) {
+			return nil, false, fiber.ErrForbidden
+		}
+		query.RoomIDs = []string{roomID}
+	}
+
+	// One more than a page tells whether there is a next one
+	query.Limit = h.Options.MaxReturnedMessage + 1
+	messages = []Message{}
+	for i, message := range h.message.Search(query) {
+		if i == h.Options.MaxReturnedMessage {
+			hasMore = true
+			break
+		}
+		message.User = h.author(message)
+		messages = append(messages, message)
+	}
+	return messages, hasMore, nil
+}
+
+func (h *Hub) search_messages(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read query from request body, the filters are optional
+	text, okText := req.Body["query"].(string)
+	roomID, okRoom := req.optionalString("roomId")
+	userID, okUser := req.optionalString("userId")
+	offset, okOffset := req.optionalNumber("offset")
+	since, okSince := req.optionalNumber("since")
+	until, okUntil := req.optionalNumber("until")
+	if !okText || !okRoom || !okUser || !okOffset || !okSince || !okUntil {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+	query := SearchQuery{
+		UserID: userID,
+		Since:  int64(since),
+		Until:  int64(until),
+		Offset: int(offset),
+	}
+
+	messages, hasMore, err := h.search(req.ClientID, text, roomID, query)
+	if err != nil {
+		h.error(conn, err)
+		return
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"query":      text,
+			"data":       &messages,
+			"hasMore":    hasMore,
+			"nextOffset": query.Offset + len(messages),
+		},
+		Type: SEARCH_RESULTS,
+	}
+
+	if err := conn.WriteJSON(res); err != nil {
+		if e := h.error(conn, fiber.ErrInternalServerError); e != nil {
+			h.unregister(conn)
+			// return
+		}
+	}
+}
+
+// SearchMessages searches the messages the user of the token can see.
+//
+//	GET /api/messages/search?q=...&roomId=...&userId=...&since=...&until=...&offset=...
+func (h *Hub) SearchMessages(c *fiber.Ctx) error {
+	userID, err := h.bearer(c)
+	if err != nil {
+		return err
+	}
+
+	since, errSince := queryInt(c, "since")
+	until, errUntil := queryInt(c, "until")
+	offset, errOffset := queryInt(c, "offset")
+	if errSince != nil || errUntil != nil || errOffset != nil {
+		return fiber.ErrBadRequest
+	}
+	query := SearchQuery{
+		UserID: c.Query("userId"),
+		Since:  since,
+		Until:  until,
+		Offset: int(offset),
+	}
+
+	messages, hasMore, err := h.search(userID, c.Query("q"), c.Query("roomId"), query)
+	if err != nil {
+		return err
+	}
+	return c.JSON(map[string]interface{}{
+		"data":       &messages,
+		"hasMore":    hasMore,
+		"nextOffset": query.Offset + len(messages),
+	})
+}
+
+// queryInt reads an optional integer from the query string, zero if missing.
+func queryInt(c *fiber.Ctx, key string) (int64, error) {
+	s := c.Query(key)
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Session is what a disconnected user leaves behind, so a reconnect within the
+// grace window gets the same user and rooms back.
+type Session struct {
+	User    User      `json:"user"`
+	RoomIDs []string  `json:"roomIds"`
+	Expires time.Time `json:"expires"`
+}
+
+type SessionStore interface {
+	Store(userID string, session Session)
+	Load(userID string) (session Session, ok bool)
+	Delete(userID string)
+}
+
+type InMemorySessionStore struct {
+	sync.Mutex
+	sessions map[string]Session
+}
+
+var _ SessionStore = (*InMemorySessionStore)(nil)
+
+func NewInMemorySessionStore() *InMemorySessionStore {
+	return &InMemorySessionStore{
+		sessions: map[string]Session{},
+	}
+}
+
+func (s *InMemorySessionStore) Store(userID string, session Session) {
+	s.Lock()
+	// Forget expired sessions while at it
+	now := time.Now()
+	for id, old := range s.sessions {
+		if now.After(old.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.sessions[userID] = session
+	s.Unlock()
+}
+
+// Load returns the session unless it is expired.
+func (s *InMemorySessionStore) Load(userID string) (session Session, ok bool) {
+	s.Lock()
+	session, ok = s.sessions[userID]
+	if ok && time.Now().After(session.Expires) {
+		delete(s.sessions, userID)
+		session, ok = Session{}, false
+	}
+	s.Unlock()
+	return session, ok
+}
+
+func (s *InMemorySessionStore) Delete(userID string) {
+	s.Lock()
+	delete(s.sessions, userID)
+	s.Unlock()
+}
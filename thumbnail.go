@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxThumbnailPixels bounds the images thumbnails are made of, a small
+	// file can decode to a huge image. Decoded it takes up to 4 bytes a pixel.
+	MaxThumbnailPixels = 16 << 20
+	// MaxThumbnailJobs bounds the images decoded at once, so concurrent
+	// uploads can not take more memory than a few of them.
+	MaxThumbnailJobs = 2
+	placeholderSize  = 32 // longer side the placeholder is computed from, in pixels
+	placeholderX     = 4  // components of the placeholder across
+	placeholderY     = 3  // and down
+
+	// thumbnailWait bounds how long an upload waits for one of the
+	// MaxThumbnailJobs before it is refused as the server being busy.
+	thumbnailWait = 10 * time.Second
+)
+
+// ThumbnailSizes bound the longer side of the thumbnails made of an image, in
+// pixels. Sizes the image is not larger than are skipped.
+var ThumbnailSizes = []int{960, 480, 160}
+
+// Thumbnail is a smaller copy of an image attachment.
+type Thumbnail struct {
+	Size     int    `json:"size"` // the one of ThumbnailSizes it was made for
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	MimeType string `json:"mimeType"`
+	URL      string `json:"url"` // needs the token of the user like the attachment
+}
+
+// thumbnails decodes the image in r and returns its thumbnails, their files
+// in the same order, and a BlurHash of it to show while they load.
+func thumbnails(attachmentID string, r io.Reader) (thumbs []Thumbnail, files [][]byte, placeholder string, err error) {
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	// Photos stay photos, anything else may have sharp edges or transparency
+	mimeType := "image/png"
+	if format == "jpeg" {
+		mimeType = "image/jpeg"
+	}
+
+	// Each size is scaled from the one before, largest first, which is
+	// cheaper than scaling the original every time
+	img := src
+	for _, size := range ThumbnailSizes {
+		w, h := fit(img.Bounds().Dx(), img.Bounds().Dy(), size)
+		if w == img.Bounds().Dx() && h == img.Bounds().Dy() {
+			continue
+		}
+		img = scale(img, w, h)
+
+		var buf bytes.Buffer
+		if mimeType == "image/jpeg" {
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
+		} else {
+			err = png.Encode(&buf, img)
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		thumbs = append(thumbs, Thumbnail{
+			Size:     size,
+			Width:    w,
+			Height:   h,
+			MimeType: mimeType,
+			URL:      fmt.Sprintf("/api/attachments/%s/thumbnails/%d", attachmentID, size),
+		})
+		files = append(files, buf.Bytes())
+	}
+
+	w, h := fit(img.Bounds().Dx(), img.Bounds().Dy(), placeholderSize)
+	return thumbs, files, blurhash(scale(img, w, h), placeholderX, placeholderY), nil
+}
+
+// fit returns the size of a w×h image scaled down, never up, so its longer
+// side is at most max.
+func fit(w, h, max int) (int, int) {
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w >= h {
+		return max, int(math.Max(1, math.Round(float64(h)*float64(max)/float64(w))))
+	}
+	return int(math.Max(1, math.Round(float64(w)*float64(max)/float64(h)))), max
+}
+
+// scale shrinks src to w×h, each pixel the average of the ones it covers.
+// The decoders have their own layouts, so the rows of src are converted one
+// at a time rather than copying all of it.
+func scale(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if img, ok := src.(*image.RGBA); ok && w == sw && h == sh {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	row := image.NewRGBA(image.Rect(0, 0, sw, 1))
+	sums := make([]int, 4*w)
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+
+		for i := range sums {
+			sums[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			draw.Draw(row, row.Bounds(), src, image.Pt(b.Min.X, b.Min.Y+sy), draw.Src)
+			for x := 0; x < w; x++ {
+				x0, x1 := x*sw/w, (x+1)*sw/w
+				if x1 == x0 {
+					x1++
+				}
+				for i := 4 * x0; i < 4*x1; i += 4 {
+					sums[4*x] += int(row.Pix[i])
+					sums[4*x+1] += int(row.Pix[i+1])
+					sums[4*x+2] += int(row.Pix[i+2])
+					sums[4*x+3] += int(row.Pix[i+3])
+				}
+			}
+		}
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+			n := (x1 - x0) * (y1 - y0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sums[4*x+c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// blurhash encodes img as a BlurHash of cx×cy components, see
+// https://github.com/woltapp/blurhash. Clients decode it to a blurred
+// picture of a few bytes.
+func blurhash(img *image.RGBA, cx, cy int) string {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					p := img.PixOffset(x, y)
+					for c := 0; c < 3; c++ {
+						f[c] += basis * srgbToLinear(img.Pix[p+c])
+					}
+				}
+			}
+			for c := range f {
+				f[c] *= normalisation / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83(cx-1+(cy-1)*9, 1))
+
+	// The AC components are quantised against the largest of them
+	maximum := 1.0
+	if len(factors) > 1 {
+		var actual float64
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actual = math.Max(actual, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(base83(quantised, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(base83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range factors[1:] {
+		var q [3]int
+		for c, v := range f {
+			q[c] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(q[0]*19*19+q[1]*19+q[2], 2))
+	}
+	return hash.String()
+}
+
+const base83Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// base83 writes n in length digits of the BlurHash alphabet.
+func base83(n int, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Digits[n%83]
+		n /= 83
+	}
+	return string(b)
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(f float64) int {
+	f = math.Max(0, math.Min(1, f))
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// thumbnailSize reads the size in the path of a thumbnail, zero if it is not
+// one of ThumbnailSizes.
+func thumbnailSize(s string) int {
+	size, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	for _, known := range ThumbnailSizes {
+		if size == known {
+			return size
+		}
+	}
+	return 0
+}
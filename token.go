@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token is expired")
+)
+
+type TokenKind string
+
+const (
+	// ResumeToken lets a reconnecting client keep its identity.
+	ResumeToken TokenKind = "resume"
+	// AuthToken connects a client as a registered account.
+	AuthToken TokenKind = "auth"
+)
+
+// TokenSigner issues and verifies tokens of the form
+// base64(kind|userID|expires).base64(hmac).
+type TokenSigner struct {
+	secret []byte
+}
+
+func NewTokenSigner(secret []byte) *TokenSigner {
+	return &TokenSigner{secret: secret}
+}
+
+func (s *TokenSigner) Sign(kind TokenKind, userID string, expires time.Time) string {
+	payload := strings.Join([]string{
+		string(kind),
+		userID,
+		strconv.FormatInt(expires.Unix(), 10),
+	}, "|")
+
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.mac([]byte(payload)))
+}
+
+// Verify returns the user id of a token of the given kind.
+func (s *TokenSigner) Verify(kind TokenKind, token string) (userID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if !hmac.Equal(sig, s.mac(payload)) {
+		return "", ErrInvalidToken
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 || fields[0] != string(kind) {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrExpiredToken
+	}
+	return fields[1], nil
+}
+
+func (s *TokenSigner) mac(payload []byte) []byte {
+	m := hmac.New(sha256.New, s.secret)
+	m.Write(payload)
+	return m.Sum(nil)
+}
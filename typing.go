@@ -0,0 +1,251 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// typingSweepInterval is how often expired typing indicators are cleared.
+const typingSweepInterval = time.Second
+
+// TypingStore tracks who is typing in which room.
+type TypingStore interface {
+	// Start marks userID as typing in roomID for ttl. It reports whether the
+	// room is to be told, which it is not while userID is already typing or
+	// within throttle of its last start.
+	Start(roomID string, userID string, now time.Time, ttl time.Duration, throttle time.Duration) bool
+	// Stop reports whether userID was typing in roomID.
+	Stop(roomID string, userID string) bool
+	// Expire stops the users whose typing expired by now and returns them as
+	// room id -> user ids.
+	Expire(now time.Time) map[string][]string
+	// ForgetRoom drops who is typing in a deleted room.
+	ForgetRoom(roomID string)
+}
+
+type typingKey struct {
+	roomID string
+	userID string
+}
+
+type typingState struct {
+	typing  bool
+	expires time.Time // typing stops by itself
+	quiet   time.Time // a new start is relayed again
+}
+
+type InMemoryTypingStore struct {
+	sync.Mutex
+	states map[typingKey]typingState
+}
+
+var _ TypingStore = (*InMemoryTypingStore)(nil)
+
+func NewInMemoryTypingStore() *InMemoryTypingStore {
+	return &InMemoryTypingStore{
+		states: map[typingKey]typingState{},
+	}
+}
+
+func (s *InMemoryTypingStore) Start(roomID string, userID string, now time.Time, ttl time.Duration, throttle time.Duration) bool {
+	key := typingKey{roomID, userID}
+
+	s.Lock()
+	defer s.Unlock()
+
+	state, ok := s.states[key]
+	if ok && state.typing {
+		state.expires = now.Add(ttl)
+		s.states[key] = state
+		return false
+	}
+	if ok && now.Before(state.quiet) {
+		return false
+	}
+
+	s.states[key] = typingState{
+		typing:  true,
+		expires: now.Add(ttl),
+		quiet:   now.Add(throttle),
+	}
+	return true
+}
+
+func (s *InMemoryTypingStore) Stop(roomID string, userID string) bool {
+	key := typingKey{roomID, userID}
+
+	s.Lock()
+	defer s.Unlock()
+
+	state, ok := s.states[key]
+	if !ok || !state.typing {
+		return false
+	}
+	// Kept until quiet so stopping does not lift the throttle
+	state.typing = false
+	s.states[key] = state
+	return true
+}
+
+func (s *InMemoryTypingStore) Expire(now time.Time) map[string][]string {
+	expired := map[string][]string{}
+
+	s.Lock()
+	for key, state := range s.states {
+		if state.typing && !now.Before(state.expires) {
+			expired[key.roomID] = append(expired[key.roomID], key.userID)
+			state.typing = false
+			s.states[key] = state
+		}
+		if !state.typing && !now.Before(state.quiet) {
+			delete(s.states, key)
+		}
+	}
+	s.Unlock()
+	return expired
+}
+
+func (s *InMemoryTypingStore) ForgetRoom(roomID string) {
+	s.Lock()
+	for key := range s.states {
+		if key.roomID == roomID {
+			delete(s.states, key)
+		}
+	}
+	s.Unlock()
+}
+
+func (h *Hub) set_typing(req *Request) {
+	// Load connection
+	conn, ok := h.connection.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrInternalServerError)
+		h.unregister(conn)
+		return
+	}
+
+	// Read roomId from request body
+	roomID, ok := req.Body["roomId"].(string)
+	if !ok {
+		h.error(conn, fiber.ErrBadRequest)
+		return
+	}
+
+	// The room may have been deleted meanwhile, only those in it type there
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+	if room.Type == DirectRoom {
+		if !contains(room.Members, req.ClientID) {
+			h.error(conn, fiber.ErrForbidden)
+			return
+		}
+	} else if !contains(h.room.Users(roomID), req.ClientID) {
+		h.error(conn, fiber.ErrForbidden)
+		return
+	}
+
+	// Load user
+	user, ok := h.user.Load(req.ClientID)
+	if !ok {
+		h.error(conn, fiber.ErrNotFound)
+		return
+	}
+
+	if req.Type == TYPING_STOP {
+		h.stop_typing(roomID, user)
+		return
+	}
+
+	// Repeated starts only keep the indicator alive
+	if !h.typing.Start(roomID, user.ID, time.Now(), h.Options.TypingTimeout, h.Options.TypingThrottle) {
+		return
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:   EVENT_TYPING_STARTED,
+		RoomID: roomID,
+		User:   &user,
+	})
+
+	h.relay_typing(roomID, user, true)
+}
+
+// stop_typing tells the room that user stopped typing, if it was.
+func (h *Hub) stop_typing(roomID string, user User) {
+	if !h.typing.Stop(roomID, user.ID) {
+		return
+	}
+
+	// Inform other processes
+	h.publish(Event{
+		Type:   EVENT_TYPING_STOPPED,
+		RoomID: roomID,
+		User:   &user,
+	})
+
+	h.relay_typing(roomID, user, false)
+}
+
+// expire_typing stops the indicators of users who went quiet without a
+// TYPING_STOP, e.g. because their client crashed.
+func (h *Hub) expire_typing(now time.Time) {
+	for roomID, userIDs := range h.typing.Expire(now) {
+		for _, userID := range userIDs {
+			user, ok := h.user.Profile(userID)
+			if !ok {
+				user = User{ID: userID}
+			}
+
+			// Inform other processes
+			h.publish(Event{
+				Type:   EVENT_TYPING_STOPPED,
+				RoomID: roomID,
+				User:   &user,
+			})
+
+			h.relay_typing(roomID, user, false)
+		}
+	}
+}
+
+// relay_typing informs the users in chat, except user itself, that user
+// started or stopped typing.
+func (h *Hub) relay_typing(roomID string, user User, typing bool) {
+	room, ok := h.room.Room(roomID)
+	if !ok {
+		return
+	}
+
+	res := Response{
+		Body: map[string]interface{}{
+			"roomId": roomID,
+			"typing": typing,
+			"data":   &user,
+		},
+		Type: USER_TYPING,
+	}
+
+	if room.Type != DirectRoom {
+		h.broadcast(roomID, user.ID, res)
+		return
+	}
+
+	for _, id := range room.Members {
+		if id == user.ID {
+			continue
+		}
+		if c, ok := h.connection.Load(id); ok {
+			if err := c.WriteJSON(res); err != nil {
+				if e := h.error(c, fiber.ErrInternalServerError); e != nil {
+					h.unregister(c)
+				}
+			}
+		}
+	}
+}
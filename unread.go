@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+)
+
+// UnreadStore counts the messages a user missed in the rooms it joined but
+// is not looking at.
+type UnreadStore interface {
+	// Focus marks roomID as the room userID is looking at and clears its
+	// count. An empty roomID means no room is focused.
+	Focus(userID string, roomID string)
+	// Add counts a new message in roomID unless userID is looking at it and
+	// returns the unread count of the room.
+	Add(userID string, roomID string) int
+	// Forget drops the count and focus of a room userID left.
+	Forget(userID string, roomID string)
+	// ForgetRoom drops the counts and focus of a deleted room for every user.
+	ForgetRoom(roomID string)
+	// Set replaces the count of roomID, e.g. with the messages left unread
+	// after a read receipt.
+	Set(userID string, roomID string, count int)
+	Counts(userID string) map[string]int
+}
+
+type InMemoryUnreadStore struct {
+	sync.Mutex
+	focused map[string]string         // user id -> room id
+	counts  map[string]map[string]int // user id -> room id -> count
+}
+
+var _ UnreadStore = (*InMemoryUnreadStore)(nil)
+
+func NewInMemoryUnreadStore() *InMemoryUnreadStore {
+	return &InMemoryUnreadStore{
+		focused: map[string]string{},
+		counts:  map[string]map[string]int{},
+	}
+}
+
+func (s *InMemoryUnreadStore) Focus(userID string, roomID string) {
+	s.Lock()
+	if roomID == "" {
+		delete(s.focused, userID)
+	} else {
+		s.focused[userID] = roomID
+		delete(s.counts[userID], roomID)
+	}
+	s.Unlock()
+}
+
+func (s *InMemoryUnreadStore) Add(userID string, roomID string) int {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.focused[userID] == roomID {
+		return 0
+	}
+	if s.counts[userID] == nil {
+		s.counts[userID] = map[string]int{}
+	}
+	s.counts[userID][roomID]++
+	return s.counts[userID][roomID]
+}
+
+func (s *InMemoryUnreadStore) Forget(userID string, roomID string) {
+	s.Lock()
+	if s.focused[userID] == roomID {
+		delete(s.focused, userID)
+	}
+	delete(s.counts[userID], roomID)
+	s.Unlock()
+}
+
+func (s *InMemoryUnreadStore) ForgetRoom(roomID string) {
+	s.Lock()
+	for userID, focused := range s.focused {
+		if focused == roomID {
+			delete(s.focused, userID)
+		}
+	}
+	for _, counts := range s.counts {
+		delete(counts, roomID)
+	}
+	s.Unlock()
+}
+
+func (s *InMemoryUnreadStore) Set(userID string, roomID string, count int) {
+	s.Lock()
+	if count == 0 {
+		delete(s.counts[userID], roomID)
+	} else {
+		if s.counts[userID] == nil {
+			s.counts[userID] = map[string]int{}
+		}
+		s.counts[userID][roomID] = count
+	}
+	s.Unlock()
+}
+
+func (s *InMemoryUnreadStore) Counts(userID string) map[string]int {
+	counts := map[string]int{}
+	s.Lock()
+	for roomID, count := range s.counts[userID] {
+		counts[roomID] = count
+	}
+	s.Unlock()
+	return counts
+}
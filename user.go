@@ -1,37 +1,68 @@
 package main
 
 import (
+	"strings"
 	"sync"
 )
 
 type User struct {
-	ID       string `json:"id"`
-	Username string `json:"username"`
-	Avatar   string `json:"avatar"`
+	ID       string   `json:"id"`
+	Username string   `json:"username"`
+	Avatar   string   `json:"avatar"`
+	Presence Presence `json:"presence"`
+	LastSeen int64    `json:"lastSeen,omitempty"` // when it was last active, in ms
+}
+
+// Account is a registered user. Its id becomes the user id of every
+// connection authenticated with its token.
+type Account struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Avatar       string `json:"avatar"`
+	PasswordHash []byte `json:"passwordHash"`
 }
 
 type UserStore interface {
 	Store(userID string, user User)
 	Load(userID string) (user User, ok bool)
+	// Delete removes a connected user. Its profile is kept.
 	Delete(userID string)
+	// Profile returns the last stored user, connected or not, so history can
+	// still name the author of old messages.
+	Profile(userID string) (user User, ok bool)
+	// StoreAccount creates or updates an account. It returns false if the
+	// username is owned by another account.
+	StoreAccount(account Account) bool
+	LoadAccount(userID string) (account Account, ok bool)
+	FindAccount(username string) (account Account, ok bool)
+	// FindUser returns the user a username refers to: the owner of the
+	// account with that name, else the only connected user with it.
+	FindUser(username string) (user User, ok bool)
 }
 
 type InMemoryUserStore struct {
 	sync.Mutex
-	users map[string]User
+	users        map[string]User
+	profiles     map[string]User
+	accounts     map[string]Account
+	accountNames map[string]string // lowercase username -> account id
 }
 
 var _ UserStore = (*InMemoryUserStore)(nil)
 
 func NewInMemoryUserStore() *InMemoryUserStore {
 	return &InMemoryUserStore{
-		users: map[string]User{},
+		users:        map[string]User{},
+		profiles:     map[string]User{},
+		accounts:     map[string]Account{},
+		accountNames: map[string]string{},
 	}
 }
 
 func (s *InMemoryUserStore) Store(userID string, user User) {
 	s.Lock()
 	s.users[userID] = user
+	s.profiles[userID] = user
 	s.Unlock()
 }
 
@@ -47,3 +78,66 @@ func (s *InMemoryUserStore) Delete(userID string) {
 	delete(s.users, userID)
 	s.Unlock()
 }
+
+func (s *InMemoryUserStore) Profile(userID string) (user User, ok bool) {
+	s.Lock()
+	user, ok = s.profiles[userID]
+	s.Unlock()
+	return user, ok
+}
+
+func (s *InMemoryUserStore) StoreAccount(account Account) bool {
+	name := strings.ToLower(account.Username)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if id, ok := s.accountNames[name]; ok && id != account.ID {
+		return false
+	}
+	if old, ok := s.accounts[account.ID]; ok {
+		delete(s.accountNames, strings.ToLower(old.Username))
+	}
+	s.accounts[account.ID] = account
+	s.accountNames[name] = account.ID
+	return true
+}
+
+func (s *InMemoryUserStore) LoadAccount(userID string) (account Account, ok bool) {
+	s.Lock()
+	account, ok = s.accounts[userID]
+	s.Unlock()
+	return account, ok
+}
+
+func (s *InMemoryUserStore) FindAccount(username string) (account Account, ok bool) {
+	s.Lock()
+	if id, found := s.accountNames[strings.ToLower(username)]; found {
+		account, ok = s.accounts[id]
+	}
+	s.Unlock()
+	return account, ok
+}
+
+func (s *InMemoryUserStore) FindUser(username string) (user User, ok bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if id, found := s.accountNames[strings.ToLower(username)]; found {
+		if user, ok = s.profiles[id]; ok {
+			return user, true
+		}
+		account := s.accounts[id]
+		return User{ID: account.ID, Username: account.Username, Avatar: account.Avatar}, true
+	}
+
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			if ok {
+				return User{}, false // ambiguous
+			}
+			user, ok = u, true
+		}
+	}
+	return user, ok
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltUserStore persists accounts and the names and avatars of profiles.
+// Connected users, presence and when users were last seen are session state
+// and only live in memory, so they are gone after a restart.
+type BoltUserStore struct {
+	sync.Mutex
+	db       *bolt.DB
+	users    map[string]User
+	profiles map[string]User // as last stored, presence included
+}
+
+var _ UserStore = (*BoltUserStore)(nil)
+
+func (s *BoltUserStore) Store(userID string, user User) {
+	s.Lock()
+	old, ok := s.profiles[userID]
+	s.users[userID] = user
+	s.profiles[userID] = user
+	s.Unlock()
+
+	// Presence changes on every connect and tick, only a new name or avatar
+	// is worth a write
+	if !ok {
+		old, ok = s.stored(userID)
+	}
+	if ok && old.Username == user.Username && old.Avatar == user.Avatar {
+		return
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(boltProfilesBucket), []byte(userID), User{
+			ID:       user.ID,
+			Username: user.Username,
+			Avatar:   user.Avatar,
+		})
+	}); err != nil {
+		log.Printf("%#v\n", err)
+	}
+}
+
+func (s *BoltUserStore) Load(userID string) (user User, ok bool) {
+	s.Lock()
+	user, ok = s.users[userID]
+	s.Unlock()
+	return user, ok
+}
+
+func (s *BoltUserStore) Delete(userID string) {
+	s.Lock()
+	delete(s.users, userID)
+	s.Unlock()
+}
+
+func (s *BoltUserStore) Profile(userID string) (user User, ok bool) {
+	s.Lock()
+	user, ok = s.profiles[userID]
+	s.Unlock()
+	if ok {
+		return user, true
+	}
+	return s.stored(userID)
+}
+
+// stored reads the persisted profile of userID.
+func (s *BoltUserStore) stored(userID string) (user User, ok bool) {
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltProfilesBucket).Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &user)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return User{}, false
+	}
+	return user, ok
+}
+
+func (s *BoltUserStore) StoreAccount(account Account) bool {
+	stored := false
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		accounts := tx.Bucket(boltAccountsBucket)
+		names := tx.Bucket(boltAccountNamesBucket)
+
+		name := []byte(strings.ToLower(account.Username))
+		if id := names.Get(name); id != nil && string(id) != account.ID {
+			return nil
+		}
+
+		// Free the old username on rename
+		if data := accounts.Get([]byte(account.ID)); data != nil {
+			var old Account
+			if err := json.Unmarshal(data, &old); err != nil {
+				return err
+			}
+			if err := names.Delete([]byte(strings.ToLower(old.Username))); err != nil {
+				return err
+			}
+		}
+
+		if err := putJSON(accounts, []byte(account.ID), account); err != nil {
+			return err
+		}
+		if err := names.Put(name, []byte(account.ID)); err != nil {
+			return err
+		}
+		stored = true
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return false
+	}
+	return stored
+}
+
+func (s *BoltUserStore) LoadAccount(userID string) (account Account, ok bool) {
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltAccountsBucket).Get([]byte(userID))
+		if data == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(data, &account)
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Account{}, false
+	}
+	return account, ok
+}
+
+func (s *BoltUserStore) FindAccount(username string) (account Account, ok bool) {
+	var userID string
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		userID = string(tx.Bucket(boltAccountNamesBucket).Get([]byte(strings.ToLower(username))))
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return Account{}, false
+	}
+	if userID == "" {
+		return Account{}, false
+	}
+	return s.LoadAccount(userID)
+}
+
+func (s *BoltUserStore) FindUser(username string) (user User, ok bool) {
+	found := false
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltAccountNamesBucket).Get([]byte(strings.ToLower(username)))
+		if id == nil {
+			return nil
+		}
+		found = true
+		if data := tx.Bucket(boltProfilesBucket).Get(id); data != nil {
+			ok = true
+			return json.Unmarshal(data, &user)
+		}
+		var account Account
+		if err := json.Unmarshal(tx.Bucket(boltAccountsBucket).Get(id), &account); err != nil {
+			return err
+		}
+		user, ok = User{ID: account.ID, Username: account.Username, Avatar: account.Avatar}, true
+		return nil
+	}); err != nil {
+		log.Printf("%#v\n", err)
+		return User{}, false
+	}
+	if found {
+		return user, ok
+	}
+
+	// Guests are found among the connected users only
+	matches := 0
+	s.Lock()
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, username) {
+			user, matches = u, matches+1
+		}
+	}
+	s.Unlock()
+	if matches != 1 {
+		return User{}, false // ambiguous otherwise
+	}
+	return user, true
+}